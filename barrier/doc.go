@@ -0,0 +1,10 @@
+/*
+The barrier module containing the master key used to protect the key material at rest
+
+middlewares.go: rejecting requests while the barrier is sealed
+
+models.go: definition of orm based data model
+
+utils.go: master key loading, seal/unseal lifecycle and wrapping helpers
+*/
+package barrier
@@ -0,0 +1,22 @@
+package barrier
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miknikif/vault-auto-unseal/common"
+)
+
+// Reject requests which require the key material while the barrier is sealed
+func SealedMiddleware() gin.HandlerFunc {
+	l, _ := common.GetLogger()
+	return func(c *gin.Context) {
+		l.Debug("Running SealedMiddleware")
+		if IsSealed() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, common.NewError("barrier", errors.New("server is sealed")))
+			return
+		}
+		c.Next()
+	}
+}
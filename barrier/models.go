@@ -0,0 +1,74 @@
+package barrier
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/common"
+)
+
+// Single row table which keeps the data required to verify the master key
+type BarrierModel struct {
+	gorm.Model
+	Salt            string
+	Canary          string
+	SecretShares    int
+	SecretThreshold int
+}
+
+func FindOneBarrier() (BarrierModel, error) {
+	var model BarrierModel
+	l, err := common.GetLogger()
+	if err != nil {
+		return model, err
+	}
+	l.Debug("Starting retrieval of the BarrierModel from the DB")
+	db, err := common.GetDB()
+	if err != nil {
+		return model, err
+	}
+	err = db.First(&model).Error
+	l.Debug("Finished retrieval of the BarrierModel from the DB")
+	return model, err
+}
+
+// Saves additional records of the initialization in the same transaction with the barrier, e.g. the root token
+type InitCallback func(tx *gorm.DB) error
+
+// Save the barrier of the initialized server, nothing is saved if the callback fails
+func saveInitialized(barrierModel *BarrierModel, callback InitCallback) error {
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Saving initialized BarrierModel to the DB")
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	if err := tx.Save(barrierModel).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if callback != nil {
+		if err := callback(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func SaveOne(data interface{}) error {
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Saving BarrierModel to the DB")
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+	err = db.Save(data).Error
+	return err
+}
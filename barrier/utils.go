@@ -0,0 +1,502 @@
+package barrier
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/miknikif/vault-auto-unseal/helper/shamir"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	MASTER_KEY_SIZE  = 32
+	KDF_SALT_SIZE    = 16
+	WRAPPED_PREFIX   = "barrier:v1:"
+	CANARY_PLAINTEXT = "vault-auto-unseal"
+)
+
+// scrypt params recommended for interactive logins
+const (
+	KDF_SCRYPT_N = 32768
+	KDF_SCRYPT_R = 8
+	KDF_SCRYPT_P = 1
+)
+
+const (
+	SEAL_TYPE_SHAMIR = "shamir"
+	SEAL_TYPE_STATIC = "static"
+)
+
+type Barrier struct {
+	Lock        sync.RWMutex
+	masterKey   []byte
+	model       *BarrierModel
+	unsealKeys  [][]byte
+	nonce       string
+	unsealHooks []func() error
+	configKey   []byte
+	configModel BarrierModel
+}
+
+type SealStatus struct {
+	Type        string
+	Initialized bool
+	Sealed      bool
+	T           int
+	N           int
+	Progress    int
+	Nonce       string
+}
+
+var b = &Barrier{}
+
+// Check if value was produced by the Wrap function
+func IsWrapped(str string) bool {
+	return strings.HasPrefix(str, WRAPPED_PREFIX)
+}
+
+// Encrypt provided plaintext with the master key
+func Wrap(pt []byte) (string, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	if b.masterKey == nil {
+		return "", errors.New("master key is not loaded")
+	}
+	return wrapWithKey(b.masterKey, pt)
+}
+
+// Decrypt value produced by the Wrap function with the master key
+func Unwrap(str string) ([]byte, error) {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	if b.masterKey == nil {
+		return nil, errors.New("master key is not loaded")
+	}
+	return unwrapWithKey(b.masterKey, str)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapWithKey(key []byte, pt []byte) (string, error) {
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ct := aesGCM.Seal(nonce, nonce, pt, nil)
+	return WRAPPED_PREFIX + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func unwrapWithKey(key []byte, str string) ([]byte, error) {
+	if !IsWrapped(str) {
+		return nil, errors.New("value isn't wrapped with the master key")
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(str, WRAPPED_PREFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aesGCM.NonceSize()
+	if len(ct) < nonceSize {
+		return nil, errors.New("wrapped value is too short")
+	}
+
+	return aesGCM.Open(nil, ct[:nonceSize], ct[nonceSize:], nil)
+}
+
+// Decode master key provided as the base64 or hex string
+// Hex is checked first, every hex string of the key length is also a valid base64 string
+func decodeMasterKey(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	var key []byte
+	var err error
+	if len(str) == hex.EncodedLen(MASTER_KEY_SIZE) {
+		key, err = hex.DecodeString(str)
+	}
+	if key == nil || err != nil {
+		key, err = base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, errors.New("master key should be base64 or hex encoded")
+		}
+	}
+	if len(key) != MASTER_KEY_SIZE {
+		return nil, fmt.Errorf("master key should be %d bytes long", MASTER_KEY_SIZE)
+	}
+	return key, nil
+}
+
+func countMasterKeySources(conf *common.MasterKeyConfig) int {
+	sources := 0
+	for _, v := range []string{conf.Key, conf.Path, conf.Passphrase} {
+		if v != "" {
+			sources++
+		}
+	}
+	return sources
+}
+
+// Load master key from one of the configured sources
+// Passphrase is stretched with scrypt, salt is kept in the BarrierModel
+func loadMasterKey(conf *common.MasterKeyConfig, barrierModel *BarrierModel) ([]byte, error) {
+	sources := countMasterKeySources(conf)
+	if sources == 0 {
+		return nil, fmt.Errorf("master key must be provided with one of the following env vars: %s_%s, %s_%s, %s_%s", common.ENV_PREFIX, common.ENV_MASTER_KEY, common.ENV_PREFIX, common.ENV_MASTER_KEY_PATH, common.ENV_PREFIX, common.ENV_MASTER_KEY_PASSPHRASE)
+	}
+	if sources > 1 {
+		return nil, errors.New("only one master key source should be specified")
+	}
+
+	switch {
+	case conf.Key != "":
+		return decodeMasterKey(conf.Key)
+	case conf.Path != "":
+		data, err := os.ReadFile(conf.Path)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMasterKey(string(data))
+	default:
+		if barrierModel.Salt == "" {
+			salt := make([]byte, KDF_SALT_SIZE)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			barrierModel.Salt = hex.EncodeToString(salt)
+		}
+		salt, err := hex.DecodeString(barrierModel.Salt)
+		if err != nil {
+			return nil, err
+		}
+		return scrypt.Key([]byte(conf.Passphrase), salt, KDF_SCRYPT_N, KDF_SCRYPT_R, KDF_SCRYPT_P, MASTER_KEY_SIZE)
+	}
+}
+
+// Function executed every time the barrier is unsealed
+func RegisterUnsealHook(hook func() error) {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	b.unsealHooks = append(b.unsealHooks, hook)
+}
+
+func runUnsealHooks() error {
+	b.Lock.RLock()
+	hooks := b.unsealHooks
+	b.Lock.RUnlock()
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func IsSealed() bool {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	return b.masterKey == nil
+}
+
+func GetSealStatus() SealStatus {
+	b.Lock.RLock()
+	defer b.Lock.RUnlock()
+	status := SealStatus{
+		Type:     SEAL_TYPE_SHAMIR,
+		Sealed:   b.masterKey == nil,
+		Progress: len(b.unsealKeys),
+		Nonce:    b.nonce,
+	}
+	if b.model != nil {
+		status.Initialized = true
+		status.T = b.model.SecretThreshold
+		status.N = b.model.SecretShares
+		if b.model.SecretShares == 0 {
+			status.Type = SEAL_TYPE_STATIC
+		}
+	}
+	return status
+}
+
+func validateSealConfig(secretShares int, secretThreshold int) error {
+	if secretShares < 1 || secretShares > 255 {
+		return errors.New("secret shares must be between 1 and 255")
+	}
+	if secretThreshold < 1 || secretThreshold > secretShares {
+		return errors.New("secret threshold must be between 1 and secret shares")
+	}
+	if secretShares > 1 && secretThreshold == 1 {
+		return errors.New("secret threshold must be greater than one for multiple shares")
+	}
+	return nil
+}
+
+// Initialize the barrier
+// Master key provided by the config is used as is and the barrier is unsealed right away,
+// otherwise new master key is generated and split into the unseal keys
+// Callback is called in the same transaction in which the barrier is saved
+func Initialize(secretShares int, secretThreshold int, callback InitCallback) ([][]byte, error) {
+	b.Lock.RLock()
+	static := b.configKey != nil
+	b.Lock.RUnlock()
+	if static {
+		return [][]byte{}, initializeStatic(callback)
+	}
+	return initializeShamir(secretShares, secretThreshold, callback)
+}
+
+func initializeStatic(callback InitCallback) error {
+	b.Lock.Lock()
+	if b.model != nil {
+		b.Lock.Unlock()
+		return errors.New("barrier is already initialized")
+	}
+
+	canary, err := wrapWithKey(b.configKey, []byte(CANARY_PLAINTEXT))
+	if err != nil {
+		b.Lock.Unlock()
+		return err
+	}
+
+	barrierModel := b.configModel
+	barrierModel.Canary = canary
+	if err := saveInitialized(&barrierModel, callback); err != nil {
+		b.Lock.Unlock()
+		return err
+	}
+	b.model = &barrierModel
+	b.masterKey = b.configKey
+	b.configKey = nil
+	b.Lock.Unlock()
+
+	return runUnsealHooks()
+}
+
+// Barrier remains sealed after the initialization
+func initializeShamir(secretShares int, secretThreshold int, callback InitCallback) ([][]byte, error) {
+	if err := validateSealConfig(secretShares, secretThreshold); err != nil {
+		return nil, err
+	}
+
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.model != nil {
+		return nil, errors.New("barrier is already initialized")
+	}
+
+	key := make([]byte, MASTER_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	canary, err := wrapWithKey(key, []byte(CANARY_PLAINTEXT))
+	if err != nil {
+		return nil, err
+	}
+
+	shares := [][]byte{key}
+	if secretShares > 1 {
+		shares, err = shamir.Split(key, secretShares, secretThreshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	barrierModel := BarrierModel{
+		Canary:          canary,
+		SecretShares:    secretShares,
+		SecretThreshold: secretThreshold,
+	}
+	if err := saveInitialized(&barrierModel, callback); err != nil {
+		return nil, err
+	}
+	b.model = &barrierModel
+
+	return shares, nil
+}
+
+// Provide one more unseal key, master key is rebuilt once the threshold is reached
+// Duplicated keys are ignored
+func Unseal(key []byte) error {
+	b.Lock.Lock()
+	if b.model == nil {
+		b.Lock.Unlock()
+		return errors.New("barrier isn't initialized")
+	}
+	if b.masterKey != nil {
+		b.Lock.Unlock()
+		return nil
+	}
+
+	keySize := MASTER_KEY_SIZE + shamir.ShareOverhead
+	if b.model.SecretThreshold == 1 {
+		keySize = MASTER_KEY_SIZE
+	}
+	if len(key) != keySize {
+		b.Lock.Unlock()
+		return fmt.Errorf("unseal key should be %d bytes long", keySize)
+	}
+
+	for _, existing := range b.unsealKeys {
+		if subtle.ConstantTimeCompare(existing, key) == 1 {
+			b.Lock.Unlock()
+			return nil
+		}
+	}
+
+	if b.nonce == "" {
+		nonce, err := uuid.NewRandom()
+		if err != nil {
+			b.Lock.Unlock()
+			return err
+		}
+		b.nonce = nonce.String()
+	}
+	b.unsealKeys = append(b.unsealKeys, key)
+	if len(b.unsealKeys) < b.model.SecretThreshold {
+		b.Lock.Unlock()
+		return nil
+	}
+
+	parts := b.unsealKeys
+	b.unsealKeys = nil
+	b.nonce = ""
+
+	masterKey := parts[0]
+	if len(parts) > 1 {
+		var err error
+		masterKey, err = shamir.Combine(parts)
+		if err != nil {
+			b.Lock.Unlock()
+			return fmt.Errorf("failed to compute master key: %w", err)
+		}
+	}
+
+	pt, err := unwrapWithKey(masterKey, b.model.Canary)
+	if err != nil || string(pt) != CANARY_PLAINTEXT {
+		b.Lock.Unlock()
+		return errors.New("provided unseal keys don't match the master key")
+	}
+	b.masterKey = masterKey
+	b.Lock.Unlock()
+
+	l, _ := common.GetLogger()
+	l.Info("Barrier unsealed")
+	return runUnsealHooks()
+}
+
+// Discard the unseal keys provided so far
+func ResetUnseal() {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	b.unsealKeys = nil
+	b.nonce = ""
+}
+
+// Forget the master key, only barriers protected with the unseal keys can be sealed
+func Seal() error {
+	b.Lock.Lock()
+	defer b.Lock.Unlock()
+	if b.model == nil {
+		return errors.New("barrier isn't initialized")
+	}
+	if b.model.SecretShares == 0 {
+		return errors.New("barrier with the master key provided by the config can't be sealed")
+	}
+	for i := range b.masterKey {
+		b.masterKey[i] = 0
+	}
+	b.masterKey = nil
+	b.unsealKeys = nil
+	b.nonce = ""
+
+	l, _ := common.GetLogger()
+	l.Info("Barrier sealed")
+	return nil
+}
+
+// Setup the barrier during startup
+// Master key provided by the config unseals the barrier right away,
+// otherwise the barrier starts sealed and waits for the unseal keys
+func Setup(c *common.Config) error {
+	c.Logger.Info("Setting up the barrier")
+	barrierModel, err := FindOneBarrier()
+	initialized := err == nil
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	if countMasterKeySources(c.Args.MasterKey) > 0 || (initialized && barrierModel.SecretShares == 0) {
+		return setupStatic(c, barrierModel, initialized)
+	}
+
+	if !initialized {
+		c.Logger.Warn("Server isn't initialized, initialize it with the /v1/sys/init endpoint")
+		return nil
+	}
+
+	b.Lock.Lock()
+	b.model = &barrierModel
+	b.Lock.Unlock()
+	c.Logger.Warn("Server is sealed, provide the unseal keys to the /v1/sys/unseal endpoint")
+	return nil
+}
+
+// Load master key from the config and verify it against the canary stored in the DB
+// Canary is created during the initialization
+func setupStatic(c *common.Config, barrierModel BarrierModel, initialized bool) error {
+	c.Logger.Info("Loading master key")
+	key, err := loadMasterKey(c.Args.MasterKey, &barrierModel)
+	if err != nil {
+		return err
+	}
+
+	if !initialized {
+		b.Lock.Lock()
+		b.configKey = key
+		b.configModel = barrierModel
+		b.Lock.Unlock()
+		c.Logger.Warn("Server isn't initialized, initialize it with the /v1/sys/init endpoint")
+		return nil
+	}
+
+	pt, err := unwrapWithKey(key, barrierModel.Canary)
+	if err != nil || string(pt) != CANARY_PLAINTEXT {
+		return errors.New("provided master key doesn't match the one used to protect the DB")
+	}
+
+	b.Lock.Lock()
+	b.model = &barrierModel
+	b.masterKey = key
+	b.Lock.Unlock()
+	c.Logger.Info("Master key loaded")
+	return runUnsealHooks()
+}
@@ -0,0 +1,250 @@
+package barrier
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/stretchr/testify/require"
+)
+
+// Barrier is set up with the fresh DB and without the master key, so it's initialized with the unseal keys
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "vau-barrier")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_DB_PATH), dir)
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_LOG_LEVEL), "error")
+
+	conf, err := common.GetConfig()
+	if err != nil {
+		panic(err)
+	}
+	conf.DB.AutoMigrate(&BarrierModel{})
+	if err := Setup(conf); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestDecodeMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, MASTER_KEY_SIZE)
+	tests := []struct {
+		name  string
+		str   string
+		valid bool
+	}{
+		{name: "base64", str: base64.StdEncoding.EncodeToString(key), valid: true},
+		{name: "hex", str: hex.EncodeToString(key), valid: true},
+		{name: "upper case hex", str: strings.ToUpper(hex.EncodeToString(key)), valid: true},
+		{name: "surrounding whitespace", str: " " + hex.EncodeToString(key) + "\n", valid: true},
+		{name: "short base64", str: base64.StdEncoding.EncodeToString(key[1:])},
+		{name: "short hex", str: hex.EncodeToString(key[1:])},
+		{name: "invalid", str: "not a key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeMasterKey(tt.str)
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, key, decoded)
+		})
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01, 0xfe}, MASTER_KEY_SIZE/2)
+	dir := t.TempDir()
+	hexPath := filepath.Join(dir, "hex")
+	require.NoError(t, os.WriteFile(hexPath, []byte(hex.EncodeToString(key)+"\n"), 0600))
+	b64Path := filepath.Join(dir, "base64")
+	require.NoError(t, os.WriteFile(b64Path, []byte(base64.StdEncoding.EncodeToString(key)), 0600))
+
+	tests := []struct {
+		name  string
+		conf  common.MasterKeyConfig
+		valid bool
+	}{
+		{name: "base64 key", conf: common.MasterKeyConfig{Key: base64.StdEncoding.EncodeToString(key)}, valid: true},
+		{name: "hex key", conf: common.MasterKeyConfig{Key: hex.EncodeToString(key)}, valid: true},
+		{name: "hex file", conf: common.MasterKeyConfig{Path: hexPath}, valid: true},
+		{name: "base64 file", conf: common.MasterKeyConfig{Path: b64Path}, valid: true},
+		{name: "missing file", conf: common.MasterKeyConfig{Path: filepath.Join(dir, "missing")}},
+		{name: "no source"},
+		{name: "several sources", conf: common.MasterKeyConfig{Key: hex.EncodeToString(key), Path: hexPath}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := loadMasterKey(&tt.conf, &BarrierModel{})
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, key, loaded)
+		})
+	}
+}
+
+// Nothing should be saved if the records of the initialization can't be saved
+func TestInitialize_CallbackFailure(t *testing.T) {
+	_, err := Initialize(1, 1, func(tx *gorm.DB) error {
+		return errors.New("unable to save the root token")
+	})
+	require.Error(t, err)
+	require.False(t, GetSealStatus().Initialized)
+	_, err = FindOneBarrier()
+	require.True(t, gorm.IsRecordNotFoundError(err))
+
+	called := false
+	keys, err := Initialize(1, 1, func(tx *gorm.DB) error {
+		called = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, called)
+	require.Len(t, keys, 1)
+	require.True(t, GetSealStatus().Initialized)
+	_, err = FindOneBarrier()
+	require.NoError(t, err)
+}
+
+// Barrier is initialized again from scratch, so every test gets its own unseal keys
+func initTestBarrier(t *testing.T, secretShares int, secretThreshold int) [][]byte {
+	conf, err := common.GetConfig()
+	require.NoError(t, err)
+	require.NoError(t, conf.DB.Unscoped().Delete(&BarrierModel{}).Error)
+	b = &Barrier{}
+	keys, err := Initialize(secretShares, secretThreshold, nil)
+	require.NoError(t, err)
+	require.Len(t, keys, secretShares)
+	require.True(t, IsSealed())
+	return keys
+}
+
+func TestUnseal_Threshold(t *testing.T) {
+	keys := initTestBarrier(t, 3, 2)
+
+	require.NoError(t, Unseal(keys[0]))
+	status := GetSealStatus()
+	require.True(t, status.Sealed)
+	require.Equal(t, 1, status.Progress)
+	require.NotEmpty(t, status.Nonce)
+	nonce := status.Nonce
+
+	// Duplicated key doesn't count towards the threshold
+	require.NoError(t, Unseal(keys[0]))
+	status = GetSealStatus()
+	require.True(t, status.Sealed)
+	require.Equal(t, 1, status.Progress)
+	require.Equal(t, nonce, status.Nonce)
+
+	require.NoError(t, Unseal(keys[2]))
+	status = GetSealStatus()
+	require.False(t, status.Sealed)
+	require.Equal(t, 0, status.Progress)
+	require.Empty(t, status.Nonce)
+
+	// Keys provided to the unsealed barrier are ignored
+	require.NoError(t, Unseal(keys[1]))
+	require.False(t, IsSealed())
+	require.Equal(t, 0, GetSealStatus().Progress)
+}
+
+func TestUnseal_SingleKey(t *testing.T) {
+	keys := initTestBarrier(t, 1, 1)
+	require.Len(t, keys[0], MASTER_KEY_SIZE)
+
+	require.Error(t, Unseal(keys[0][1:]))
+	require.True(t, IsSealed())
+	require.NoError(t, Unseal(keys[0]))
+	require.False(t, IsSealed())
+}
+
+// Keys which don't match the canary reset the progress, so the unseal can be started from scratch
+func TestUnseal_WrongKeys(t *testing.T) {
+	other := initTestBarrier(t, 3, 2)
+	keys := initTestBarrier(t, 3, 2)
+
+	require.NoError(t, Unseal(other[0]))
+	require.Error(t, Unseal(other[1]))
+	status := GetSealStatus()
+	require.True(t, status.Sealed)
+	require.Equal(t, 0, status.Progress)
+	require.Empty(t, status.Nonce)
+
+	corrupted := append([]byte(nil), keys[1]...)
+	corrupted[0] ^= 0xff
+	require.NoError(t, Unseal(keys[0]))
+	require.Error(t, Unseal(corrupted))
+	status = GetSealStatus()
+	require.True(t, status.Sealed)
+	require.Equal(t, 0, status.Progress)
+
+	// Key of the wrong size is rejected without counting towards the threshold
+	require.Error(t, Unseal(keys[0][1:]))
+	require.Equal(t, 0, GetSealStatus().Progress)
+
+	require.NoError(t, Unseal(keys[0]))
+	require.NoError(t, Unseal(keys[1]))
+	require.False(t, IsSealed())
+}
+
+func TestResetUnseal(t *testing.T) {
+	keys := initTestBarrier(t, 3, 3)
+
+	require.NoError(t, Unseal(keys[0]))
+	require.NoError(t, Unseal(keys[1]))
+	require.Equal(t, 2, GetSealStatus().Progress)
+	ResetUnseal()
+	status := GetSealStatus()
+	require.Equal(t, 0, status.Progress)
+	require.Empty(t, status.Nonce)
+
+	// Key provided before the reset has to be provided again
+	require.NoError(t, Unseal(keys[2]))
+	require.NoError(t, Unseal(keys[1]))
+	require.True(t, IsSealed())
+	require.NoError(t, Unseal(keys[0]))
+	require.False(t, IsSealed())
+}
+
+func TestSeal(t *testing.T) {
+	keys := initTestBarrier(t, 3, 2)
+	require.NoError(t, Unseal(keys[0]))
+	require.NoError(t, Unseal(keys[1]))
+	require.False(t, IsSealed())
+
+	require.NoError(t, Seal())
+	status := GetSealStatus()
+	require.True(t, status.Sealed)
+	require.True(t, status.Initialized)
+	require.Equal(t, 0, status.Progress)
+	_, err := Wrap([]byte("test"))
+	require.Error(t, err)
+
+	// Barrier is unsealed again with any keys matching the threshold
+	require.NoError(t, Unseal(keys[2]))
+	require.NoError(t, Unseal(keys[0]))
+	require.False(t, IsSealed())
+	wrapped, err := Wrap([]byte("test"))
+	require.NoError(t, err)
+	pt, err := Unwrap(wrapped)
+	require.NoError(t, err)
+	require.Equal(t, []byte("test"), pt)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/miknikif/vault-auto-unseal/barrier"
 	"github.com/miknikif/vault-auto-unseal/common"
 	"github.com/miknikif/vault-auto-unseal/keys"
 	"github.com/miknikif/vault-auto-unseal/policies"
@@ -18,9 +19,6 @@ func Seed(c *common.Config) error {
 	if err := policies.SeedDB(c); err != nil {
 		return err
 	}
-	if err := tokens.SeedDB(c); err != nil {
-		return err
-	}
 	c.Logger.Info("Seeding completed")
 	return nil
 }
@@ -32,12 +30,22 @@ func Migrate(c *common.Config) error {
 	c.DB.AutoMigrate(&tokens.TokenModel{})
 	c.DB.AutoMigrate(&keys.AESKeyModel{})
 	c.DB.AutoMigrate(&keys.KeyModel{})
+	c.DB.AutoMigrate(&keys.WrappingKeyModel{})
+	c.DB.AutoMigrate(&keys.KeyCacheConfigModel{})
+	c.DB.AutoMigrate(&barrier.BarrierModel{})
 	c.Logger.Info(fmt.Sprintf("Migration of the %s DB completed", c.Args.DBName))
 	if c.DBStatus == common.INIT_DB_RES_CREATED {
 		if err := Seed(c); err != nil {
 			return err
 		}
 	}
+	barrier.RegisterUnsealHook(keys.WrapPlaintextKeys)
+	barrier.RegisterUnsealHook(keys.GenerateMissingHMACKeys)
+	barrier.RegisterUnsealHook(keys.PurgeKeyCache)
+	barrier.RegisterUnsealHook(keys.LoadKeyCacheConfig)
+	if err := barrier.Setup(c); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -64,10 +72,16 @@ func StartHttpServer() error {
 
 	v1 := router.Group("/v1")
 	v1.Use(tokens.AuthMiddleware())
+	sys.SealRegister(v1.Group("/sys"))
+	sys.CapabilitiesRegister(v1.Group("/sys"))
 	tokens.TokenRegister(v1.Group("/auth/token"))
 	policies.PolicyRegister(v1.Group("/sys/policy"))
 	policies.PolicyRegister(v1.Group("/sys/policies/acl"))
 	keys.KeysOperationsRegister(v1.Group("/transit"))
+	sys.RandomRegister(v1.Group("/sys/tools"))
+	sys.RandomRegister(v1.Group("/transit"))
+
+	keys.StartAutoRotation(keys.AUTO_ROTATE_CHECK_INTERVAL)
 
 	server := &http.Server{
 		Addr:     fmt.Sprintf("%s:%d", c.Args.Host, c.Args.Port),
@@ -29,6 +29,9 @@ const (
 	ENV_LOG_FORMAT             = "LOG_FORMAT"
 	ENV_LOG_LEVEL              = "LOG_LEVEL"
 	ENV_PRODUCTION             = "PRODUCTION"
+	ENV_MASTER_KEY             = "MASTER_KEY"
+	ENV_MASTER_KEY_PATH        = "MASTER_KEY_PATH"
+	ENV_MASTER_KEY_PASSPHRASE  = "MASTER_KEY_PASSPHRASE"
 )
 
 // Log specific configuration provided during startup
@@ -37,6 +40,14 @@ type LogConfig struct {
 	LogLevel  string
 }
 
+// Master key sources provided during startup
+// Only one of them should be specified
+type MasterKeyConfig struct {
+	Key        string
+	Path       string
+	Passphrase string
+}
+
 // App params provided during startup
 // This struct is inialized only once, during startup
 // It's should remain unchanged
@@ -47,6 +58,7 @@ type Params struct {
 	DBName       string
 	IsProduction bool
 	LogConfig    *LogConfig
+	MasterKey    *MasterKeyConfig
 }
 
 // TLS conf
@@ -196,8 +208,15 @@ func (c *Config) readEnv() error {
 		LogLevel:  readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_LOG_LEVEL), "info"),
 	}
 
+	masterKey := &MasterKeyConfig{
+		Key:        readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_MASTER_KEY), ""),
+		Path:       readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_MASTER_KEY_PATH), ""),
+		Passphrase: readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_MASTER_KEY_PASSPHRASE), ""),
+	}
+
 	cp := &Params{
 		LogConfig:    log,
+		MasterKey:    masterKey,
 		Host:         readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_HOST), "0.0.0.0"),
 		Port:         readEnvInt(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_PORT), 8200),
 		DBPath:       readEnv(fmt.Sprintf("%s_%s", ENV_PREFIX, ENV_DB_PATH), "."),
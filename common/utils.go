@@ -2,10 +2,13 @@ package common
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -17,10 +20,15 @@ const (
 	VAULT_TOKEN        = "vaultToken"
 	VAULT_TOKEN_MODEL  = "vaultTokenModel"
 	SESSION_POLICIES   = "sessionPolicies"
-	PATH_CAPABILITIES  = "pathCapabilities"
+	SESSION_ACL        = "sessionACL"
 	IS_ROOT            = "isRoot"
 )
 
+// ACL compiled from all the policies of the token, it's implemented by the policies module
+type ACL interface {
+	HasCapability(path string, capability string) bool
+}
+
 // All currently used ENV VARS
 // Used in the following form: <ENV_PREFIX>_<ENV_VAR>
 
@@ -80,6 +88,58 @@ func ParseBool(str string, def bool) bool {
 	return b
 }
 
+// Parse Duration - parsing durations in seconds from strings
+// Accepts plain seconds ("3600"), go durations ("1h30m") and days ("90d")
+func ParseDurationSeconds(str string) (int, error) {
+	if str == "" {
+		return 0, nil
+	}
+	if i, err := strconv.Atoi(str); err == nil {
+		return i, nil
+	}
+	if days, ok := strings.CutSuffix(str, "d"); ok {
+		i, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("unable to parse duration %q", str)
+		}
+		return i * 24 * 60 * 60, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse duration %q", str)
+	}
+	return int(d.Seconds()), nil
+}
+
+// Request field which could be sent as a JSON string, number or bool
+// Set is true only if the field was present in the request
+type OptionalField struct {
+	Value string
+	Set   bool
+}
+
+func (f *OptionalField) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*f = OptionalField{}
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*f = OptionalField{Value: str, Set: true}
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v.(type) {
+	case bool, float64:
+		*f = OptionalField{Value: string(data), Set: true}
+		return nil
+	}
+	return fmt.Errorf("unexpected value %s, string, number or bool is expected", data)
+}
+
 // Helper function to read INT parameter from the ENV
 func readEnvInt(key string, def int) int {
 	v := readEnv(key, fmt.Sprintf("%d", def))
@@ -140,6 +200,11 @@ func Bind(c *gin.Context, obj interface{}) error {
 	return c.ShouldBindWith(obj, b)
 }
 
+// Body is always decoded as JSON regardless of the Content-Type, like the Vault API does it
+func BindJSON(c *gin.Context, obj interface{}) error {
+	return c.ShouldBindWith(obj, binding.JSON)
+}
+
 func EncToB64(str string) string {
 	l, _ := GetLogger()
 	l.Debug("EncToB64 - started", "str", str)
@@ -179,26 +244,56 @@ func DecBytesFromB64(str string) ([]byte, error) {
 	return res, nil
 }
 
-// Verify create acces on individual path
-func VerifyCreateAccess(c *gin.Context) bool {
-	l, _ := GetLogger()
-	isRoot := c.MustGet(IS_ROOT).(bool)
-	l.Debug("VerifyCreateAccess", "isRoot", isRoot)
-	if isRoot {
-		return true
+// Check if the resource addressed by the request already exists
+type ExistenceCheck func(c *gin.Context) (bool, error)
+
+// Existence checks of the routes, keyed by the full path of the route
+var existenceChecks = struct {
+	sync.RWMutex
+	checks map[string]ExistenceCheck
+}{checks: map[string]ExistenceCheck{}}
+
+// Register the existence check of the route, POST and PUT requests to the route are
+// treated as create if the resource doesn't exist yet, and as update otherwise
+func RegisterExistenceCheck(fullPath string, check ExistenceCheck) {
+	existenceChecks.Lock()
+	defer existenceChecks.Unlock()
+	existenceChecks.checks[fullPath] = check
+}
+
+// Check if the resource of the request exists, routes without the existence check are always updated
+func CheckExistence(c *gin.Context) (bool, error) {
+	existenceChecks.RLock()
+	check, ok := existenceChecks.checks[c.FullPath()]
+	existenceChecks.RUnlock()
+	if !ok {
+		return true, nil
 	}
-	capabilities := c.MustGet(PATH_CAPABILITIES).(map[string]bool)
-	return capabilities["create"]
+	return check(c)
 }
 
-// Verify create acces on individual path
-func VerifyListAccess(c *gin.Context) bool {
+// Check if the token of the request has the capability on the requested path
+// Root tokens are allowed to do anything
+func HasCapability(c *gin.Context, capability string) bool {
 	l, _ := GetLogger()
-	isRoot := c.MustGet(IS_ROOT).(bool)
-	l.Debug("VerifyListAccess", "isRoot", isRoot)
+	isRoot := c.GetBool(IS_ROOT)
+	l.Debug("HasCapability", "capability", capability, "isRoot", isRoot)
 	if isRoot {
 		return true
 	}
-	capabilities := c.MustGet(PATH_CAPABILITIES).(map[string]bool)
-	return capabilities["list"]
+	acl, ok := c.Get(SESSION_ACL)
+	if !ok {
+		return false
+	}
+	return acl.(ACL).HasCapability(GetRequestPath(c), capability)
+}
+
+// Verify list acces on individual path
+func VerifyListAccess(c *gin.Context) bool {
+	return HasCapability(c, "list")
+}
+
+// Verify sudo acces on individual path
+func VerifySudoAccess(c *gin.Context) bool {
+	return HasCapability(c, "sudo")
 }
@@ -7,6 +7,9 @@ export VAULT_AUTO_UNSEAL_PRODUCTION="true"
 # Debug logging
 export VAULT_AUTO_UNSEAL_LOG_LEVEL="INFO"
 
+# Master key
+export VAULT_AUTO_UNSEAL_MASTER_KEY_PATH="${PWD}/master.key"
+
 # TLS
 # export VAULT_AUTO_UNSEAL_CLIENT_CA_CRT_PATH="${PWD}/tls/ca.crt"
 export VAULT_AUTO_UNSEAL_CA_CRT_PATH="${PWD}/tls/ca.crt"
@@ -0,0 +1,120 @@
+package kwp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// AES key wrap with padding as defined in RFC 5649
+
+const (
+	// semiblockSize is the size of the blocks the data is processed in
+	semiblockSize = 8
+
+	// maxWrapSize is the max size of the data which could be wrapped,
+	// message length indicator is only 32 bits long
+	maxWrapSize = math.MaxUint32
+)
+
+// ivPrefix is the alternative initial value prefix from the RFC 5649
+var ivPrefix = []byte{0xA6, 0x59, 0x59, 0xA6}
+
+// Wrap wraps the provided data with the key encryption key
+func Wrap(kek, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || uint64(len(data)) > maxWrapSize {
+		return nil, errors.New("kwp: invalid data size")
+	}
+
+	// Data is padded with zeroes to the multiple of the semiblock size
+	paddedLen := (len(data) + semiblockSize - 1) / semiblockSize * semiblockSize
+	iv := make([]byte, semiblockSize)
+	copy(iv, ivPrefix)
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(data)))
+
+	out := make([]byte, semiblockSize+paddedLen)
+	copy(out, iv)
+	copy(out[semiblockSize:], data)
+
+	// Single semiblock of data is encrypted together with the initial value
+	if paddedLen == semiblockSize {
+		block.Encrypt(out, out)
+		return out, nil
+	}
+
+	wrap(block, out)
+	return out, nil
+}
+
+// Unwrap unwraps the data which was wrapped with the key encryption key
+func Unwrap(kek, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 2*semiblockSize || len(wrapped)%semiblockSize != 0 {
+		return nil, errors.New("kwp: invalid wrapped data size")
+	}
+
+	out := make([]byte, len(wrapped))
+	copy(out, wrapped)
+	if len(out) == 2*semiblockSize {
+		block.Decrypt(out, out)
+	} else {
+		unwrap(block, out)
+	}
+
+	// Initial value and padding are checked together, so the failure reason isn't leaked
+	paddedLen := len(out) - semiblockSize
+	dataLen := int(binary.BigEndian.Uint32(out[4:semiblockSize]))
+	valid := subtle.ConstantTimeCompare(out[:4], ivPrefix)
+	if dataLen > paddedLen || dataLen <= paddedLen-semiblockSize {
+		valid = 0
+		dataLen = paddedLen
+	}
+	padding := out[semiblockSize+dataLen:]
+	valid &= subtle.ConstantTimeCompare(padding, make([]byte, len(padding)))
+	if valid != 1 {
+		return nil, errors.New("kwp: integrity check failed")
+	}
+	return out[semiblockSize : semiblockSize+dataLen], nil
+}
+
+// wrap is the wrapping process W from the RFC 3394, buf holds the initial value and the data
+func wrap(block cipher.Block, buf []byte) {
+	n := len(buf)/semiblockSize - 1
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, buf[:semiblockSize])
+			copy(b[semiblockSize:], buf[i*semiblockSize:(i+1)*semiblockSize])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:semiblockSize], binary.BigEndian.Uint64(b[:semiblockSize])^t)
+			copy(buf[i*semiblockSize:], b[semiblockSize:])
+		}
+	}
+}
+
+// unwrap is the unwrapping process W-1 from the RFC 3394, buf holds the wrapped data
+func unwrap(block cipher.Block, buf []byte) {
+	n := len(buf)/semiblockSize - 1
+	b := make([]byte, aes.BlockSize)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:semiblockSize], binary.BigEndian.Uint64(buf[:semiblockSize])^t)
+			copy(b[semiblockSize:], buf[i*semiblockSize:(i+1)*semiblockSize])
+			block.Decrypt(b, b)
+			copy(buf[:semiblockSize], b[:semiblockSize])
+			copy(buf[i*semiblockSize:], b[semiblockSize:])
+		}
+	}
+}
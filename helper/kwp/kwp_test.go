@@ -0,0 +1,94 @@
+package kwp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test vectors from the RFC 5649 section 6
+var rfcVectors = []struct {
+	kek     string
+	data    string
+	wrapped string
+}{
+	{
+		kek:     "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+		data:    "c37b7e6492584340bed12207808941155068f738",
+		wrapped: "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+	},
+	{
+		kek:     "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8",
+		data:    "466f7250617369",
+		wrapped: "afbeb0f07dfbf5419200f2ccb50bb24f",
+	},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	bs, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return bs
+}
+
+func TestWrap_RFCVectors(t *testing.T) {
+	for _, v := range rfcVectors {
+		wrapped, err := Wrap(decodeHex(t, v.kek), decodeHex(t, v.data))
+		require.NoError(t, err)
+		require.Equal(t, v.wrapped, hex.EncodeToString(wrapped))
+	}
+}
+
+func TestUnwrap_RFCVectors(t *testing.T) {
+	for _, v := range rfcVectors {
+		data, err := Unwrap(decodeHex(t, v.kek), decodeHex(t, v.wrapped))
+		require.NoError(t, err)
+		require.Equal(t, v.data, hex.EncodeToString(data))
+	}
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+
+	for size := 1; size <= 100; size++ {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		wrapped, err := Wrap(kek, data)
+		require.NoError(t, err)
+		require.Len(t, wrapped, (size+15)/8*8)
+
+		out, err := Unwrap(kek, wrapped)
+		require.NoError(t, err)
+		require.Equal(t, data, out)
+	}
+}
+
+func TestUnwrap_invalid(t *testing.T) {
+	kek := make([]byte, 32)
+	wrapped, err := Wrap(kek, []byte("test data for the wrapping"))
+	require.NoError(t, err)
+
+	_, err = Unwrap(kek, wrapped[:len(wrapped)-1])
+	require.Error(t, err)
+
+	_, err = Unwrap(kek, wrapped[:8])
+	require.Error(t, err)
+
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = Unwrap(kek, wrapped)
+	require.Error(t, err)
+
+	other := make([]byte, 32)
+	other[0] = 1
+	wrapped[len(wrapped)-1] ^= 1
+	_, err = Unwrap(other, wrapped)
+	require.Error(t, err)
+
+	_, err = Wrap(kek, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,355 @@
+package keys
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Key types and KDFs are stored as numbers in the Vault backups
+var vaultKeyTypes = map[KeyType]int{
+	KEY_TYPE_AES256_GCM96:      0,
+	KEY_TYPE_ECDSA_P256:        1,
+	KEY_TYPE_ED25519:           2,
+	KEY_TYPE_RSA_2048:          3,
+	KEY_TYPE_RSA_4096:          4,
+	KEY_TYPE_CHACHA20_POLY1305: 5,
+	KEY_TYPE_ECDSA_P384:        6,
+	KEY_TYPE_AES128_GCM96:      8,
+	KEY_TYPE_RSA_3072:          9,
+}
+
+const VAULT_KDF_HKDF_SHA256 = 1
+
+// Convergent nonce is derived in the same way as by the version 3 of the Vault convergent encryption
+const VAULT_CONVERGENT_VERSION = 3
+
+// Backup blob is the b64 encoded JSON in the same format as the Vault backups
+// So keys could be moved between the instances of this server, or into Vault
+type backupData struct {
+	Policy       *backupPolicy  `json:"policy"`
+	ArchivedKeys *backupArchive `json:"archived_keys"`
+}
+
+type backupPolicy struct {
+	Name                     string                    `json:"name"`
+	Type                     int                       `json:"type"`
+	Keys                     map[string]backupKeyEntry `json:"keys"`
+	Derived                  bool                      `json:"derived"`
+	KDF                      int                       `json:"kdf"`
+	ConvergentEncryption     bool                      `json:"convergent_encryption"`
+	ConvergentVersion        int                       `json:"convergent_version"`
+	Exportable               bool                      `json:"exportable"`
+	MinDecryptionVersion     int                       `json:"min_decryption_version"`
+	MinEncryptionVersion     int                       `json:"min_encryption_version"`
+	LatestVersion            int                       `json:"latest_version"`
+	ArchiveVersion           int                       `json:"archive_version"`
+	ArchiveMinVersion        int                       `json:"archive_min_version"`
+	MinAvailableVersion      int                       `json:"min_available_version"`
+	DeletionAllowed          bool                      `json:"deletion_allowed"`
+	AllowPlaintextBackup     bool                      `json:"allow_plaintext_backup"`
+	AutoRotatePeriod         time.Duration             `json:"auto_rotate_period"`
+	Imported                 bool                      `json:"imported"`
+	AllowImportedKeyRotation bool                      `json:"allow_imported_key_rotation"`
+	BackupInfo               *backupInfo               `json:"backup_info"`
+}
+
+type backupInfo struct {
+	Time    time.Time `json:"time"`
+	Version int       `json:"version"`
+}
+
+type backupArchive struct {
+	Keys []backupKeyEntry `json:"keys"`
+}
+
+// Single version of the key, only the fields matching the key type are set
+type backupKeyEntry struct {
+	Key                []byte          `json:"key"`
+	HMACKey            []byte          `json:"hmac_key"`
+	CreationTime       time.Time       `json:"time"`
+	EC_X               *big.Int        `json:"ec_x"`
+	EC_Y               *big.Int        `json:"ec_y"`
+	EC_D               *big.Int        `json:"ec_d"`
+	RSAKey             *rsa.PrivateKey `json:"rsa_key"`
+	FormattedPublicKey string          `json:"public_key"`
+	CreationUnix       int64           `json:"creation_time"`
+	ConvergentVersion  int             `json:"convergent_version"`
+}
+
+// Create the backup blob with the config and all the available versions of the key
+func backupKey(keyModel KeyModel) (string, error) {
+	keyType, ok := vaultKeyTypes[keyModel.Type]
+	if !ok {
+		return "", fmt.Errorf("backup isn't supported for the %s keys", keyModel.Type)
+	}
+
+	// Vault is using 0 as the min available version of the never trimmed keys
+	minAvailableVersion := keyModel.MinAvailableVersion
+	if minAvailableVersion <= 1 {
+		minAvailableVersion = 0
+	}
+
+	policy := &backupPolicy{
+		Name:                     keyModel.Name,
+		Type:                     keyType,
+		Keys:                     make(map[string]backupKeyEntry),
+		Derived:                  keyModel.Derived,
+		ConvergentEncryption:     keyModel.ConvergentEncryption,
+		Exportable:               keyModel.Exportable,
+		MinDecryptionVersion:     keyModel.MinDecryptionVersion,
+		MinEncryptionVersion:     keyModel.MinEncryptionVersion,
+		LatestVersion:            keyModel.LatestVersion,
+		ArchiveVersion:           keyModel.LatestVersion,
+		ArchiveMinVersion:        minAvailableVersion,
+		MinAvailableVersion:      minAvailableVersion,
+		DeletionAllowed:          keyModel.DeletionAllowed,
+		AllowPlaintextBackup:     keyModel.AllowPlaintextBackup,
+		AutoRotatePeriod:         time.Duration(keyModel.AutoRotatePeriod) * time.Second,
+		Imported:                 keyModel.ImportedKey,
+		AllowImportedKeyRotation: keyModel.AllowImportedKeyRotation,
+		BackupInfo:               &backupInfo{Time: time.Now().UTC(), Version: keyModel.LatestVersion},
+	}
+	if keyModel.Derived {
+		policy.KDF = VAULT_KDF_HKDF_SHA256
+	}
+	if keyModel.ConvergentEncryption {
+		policy.ConvergentVersion = VAULT_CONVERGENT_VERSION
+	}
+
+	archive := &backupArchive{Keys: make([]backupKeyEntry, keyModel.LatestVersion-minAvailableVersion+1)}
+	for _, key := range keyModel.Keys {
+		entry, err := newBackupKeyEntry(keyModel.Type, key)
+		if err != nil {
+			return "", fmt.Errorf("unable to backup key version v%d: %w", key.Version, err)
+		}
+		if keyModel.ConvergentEncryption {
+			entry.ConvergentVersion = VAULT_CONVERGENT_VERSION
+		}
+		policy.Keys[strconv.Itoa(key.Version)] = entry
+		if i := key.Version - minAvailableVersion; i >= 0 && i < len(archive.Keys) {
+			archive.Keys[i] = entry
+		}
+	}
+
+	bs, err := json.Marshal(backupData{Policy: policy, ArchivedKeys: archive})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bs), nil
+}
+
+// Vault keeps the convergent version per key version, the version of the policy is used by the older keys
+func (p *backupPolicy) convergentVersion(entry backupKeyEntry) int {
+	if entry.ConvergentVersion != 0 {
+		return entry.ConvergentVersion
+	}
+	if p.ConvergentVersion == 0 {
+		return 1
+	}
+	return p.ConvergentVersion
+}
+
+// Convert single version of the key to the backup format
+func newBackupKeyEntry(keyType KeyType, key AESKeyModel) (backupKeyEntry, error) {
+	entry := backupKeyEntry{
+		CreationTime: time.Unix(int64(key.Name), 0).UTC(),
+		CreationUnix: int64(key.Name),
+	}
+	hmacKey, err := key.HMACKey.decode()
+	if err != nil {
+		return entry, err
+	}
+	entry.HMACKey = hmacKey
+
+	if !keyType.IsAsymmetric() {
+		entry.Key, err = key.AESKey.decode()
+		return entry, err
+	}
+
+	signer, err := key.AESKey.decodeSigner(keyType)
+	if err != nil {
+		return entry, err
+	}
+	if entry.FormattedPublicKey, err = key.AESKey.publicKey(keyType); err != nil {
+		return entry, err
+	}
+	switch pk := signer.(type) {
+	case ed25519.PrivateKey:
+		entry.Key = pk
+	case *rsa.PrivateKey:
+		entry.RSAKey = pk
+	case *ecdsa.PrivateKey:
+		entry.EC_X = pk.X
+		entry.EC_Y = pk.Y
+		entry.EC_D = pk.D
+	default:
+		return entry, errors.New("unsupported private key type")
+	}
+	return entry, nil
+}
+
+// Parse the backup blob and convert it to the key which could be saved to the DB
+// Versions missing from the policy are looked up in the archived keys
+func restoreKey(backup string) (KeyModel, error) {
+	var keyModel KeyModel
+	bs, err := base64.StdEncoding.DecodeString(backup)
+	if err != nil {
+		return keyModel, errors.New("backup should be b64 encoded")
+	}
+	var data backupData
+	if err := json.Unmarshal(bs, &data); err != nil {
+		return keyModel, fmt.Errorf("unable to parse backup: %w", err)
+	}
+	policy := data.Policy
+	if policy == nil {
+		return keyModel, errors.New("backup doesn't contain the key policy")
+	}
+
+	keyType := KeyType("")
+	for t, i := range vaultKeyTypes {
+		if i == policy.Type {
+			keyType = t
+		}
+	}
+	if keyType == "" {
+		return keyModel, fmt.Errorf("unsupported key type %d in backup", policy.Type)
+	}
+	if policy.Derived && policy.KDF != VAULT_KDF_HKDF_SHA256 {
+		return keyModel, errors.New("only the hkdf_sha256 derived keys could be restored")
+	}
+
+	entries := make(map[int]backupKeyEntry)
+	if data.ArchivedKeys != nil {
+		for i, entry := range data.ArchivedKeys.Keys {
+			if version := i + policy.ArchiveMinVersion; version > 0 {
+				entries[version] = entry
+			}
+		}
+	}
+	for v, entry := range policy.Keys {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return keyModel, fmt.Errorf("invalid key version %q in backup", v)
+		}
+		entries[version] = entry
+	}
+
+	minAvailableVersion := policy.MinAvailableVersion
+	if minAvailableVersion < 1 {
+		minAvailableVersion = 1
+	}
+	for version := minAvailableVersion; version <= policy.LatestVersion; version++ {
+		entry, ok := entries[version]
+		if !ok {
+			return keyModel, fmt.Errorf("key version v%d is missing from backup", version)
+		}
+		if policy.ConvergentEncryption && policy.convergentVersion(entry) != VAULT_CONVERGENT_VERSION {
+			return keyModel, fmt.Errorf("key version v%d uses the version %d of the convergent encryption, only the version %d is supported", version, policy.convergentVersion(entry), VAULT_CONVERGENT_VERSION)
+		}
+		key, err := restoreKeyEntry(keyType, version, entry)
+		if err != nil {
+			return keyModel, fmt.Errorf("unable to restore key version v%d: %w", version, err)
+		}
+		keyModel.Keys = append(keyModel.Keys, key)
+	}
+	if len(keyModel.Keys) == 0 {
+		return keyModel, errors.New("backup doesn't contain any key versions")
+	}
+
+	keyModel.Name = policy.Name
+	keyModel.Type = keyType
+	keyModel.AllowPlaintextBackup = policy.AllowPlaintextBackup
+	keyModel.AutoRotatePeriod = int(policy.AutoRotatePeriod.Seconds())
+	keyModel.DeletionAllowed = policy.DeletionAllowed
+	keyModel.Derived = policy.Derived
+	keyModel.ConvergentEncryption = policy.ConvergentEncryption
+	keyModel.Exportable = policy.Exportable
+	keyModel.ImportedKey = policy.Imported
+	keyModel.AllowImportedKeyRotation = policy.AllowImportedKeyRotation
+	keyModel.LatestVersion = policy.LatestVersion
+	keyModel.MinAvailableVersion = minAvailableVersion
+	keyModel.MinDecryptionVersion = policy.MinDecryptionVersion
+	keyModel.MinEncryptionVersion = policy.MinEncryptionVersion
+	keyModel.SupportsDecryption = keyType.SupportsEncryption()
+	keyModel.SupportsEncryption = keyType.SupportsEncryption()
+	keyModel.SupportsSigning = keyType.SupportsSigning()
+	keyModel.SupportsDerivation = keyType.SupportsDerivation()
+	if keyModel.MinDecryptionVersion < minAvailableVersion {
+		keyModel.MinDecryptionVersion = minAvailableVersion
+	}
+	if keyModel.MinEncryptionVersion < minAvailableVersion {
+		keyModel.MinEncryptionVersion = minAvailableVersion
+	}
+	return keyModel, nil
+}
+
+// Convert single version of the key from the backup format
+// HMAC key is generated if it's missing from the backup
+func restoreKeyEntry(keyType KeyType, version int, entry backupKeyEntry) (AESKeyModel, error) {
+	key := AESKeyModel{Name: int(entry.CreationUnix), Version: version}
+	if key.Name == 0 {
+		key.Name = int(entry.CreationTime.Unix())
+	}
+
+	var err error
+	if len(entry.HMACKey) > 0 {
+		key.HMACKey = AESKey(hex.EncodeToString(entry.HMACKey))
+	} else if key.HMACKey, err = generateAESKey(HMAC_KEY_SIZE); err != nil {
+		return key, err
+	}
+
+	switch {
+	case !keyType.IsAsymmetric():
+		if len(entry.Key) != symmetricKeySize(keyType) {
+			return key, errors.New("invalid key size")
+		}
+		key.AESKey = AESKey(hex.EncodeToString(entry.Key))
+	case keyType.IsRSA():
+		if entry.RSAKey == nil {
+			return key, errors.New("RSA key is missing")
+		}
+		if err := entry.RSAKey.Validate(); err != nil {
+			return key, err
+		}
+		entry.RSAKey.Precompute()
+		key.AESKey = AESKey(hex.EncodeToString(x509.MarshalPKCS1PrivateKey(entry.RSAKey)))
+	case keyType == KEY_TYPE_ED25519:
+		if len(entry.Key) != ed25519.PrivateKeySize {
+			return key, errors.New("invalid ed25519 key size")
+		}
+		key.AESKey, err = marshalPrivateKey(ed25519.PrivateKey(entry.Key))
+	default:
+		if entry.EC_X == nil || entry.EC_Y == nil || entry.EC_D == nil {
+			return key, errors.New("ECDSA key is missing")
+		}
+		curve := elliptic.P256()
+		if keyType == KEY_TYPE_ECDSA_P384 {
+			curve = elliptic.P384()
+		}
+		if !curve.IsOnCurve(entry.EC_X, entry.EC_Y) {
+			return key, errors.New("ECDSA public key isn't on the curve")
+		}
+		pk := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: entry.EC_X, Y: entry.EC_Y}, D: entry.EC_D}
+		key.AESKey, err = marshalPrivateKey(pk)
+	}
+	return key, err
+}
+
+// Size of the key material of the symmetric key types
+func symmetricKeySize(keyType KeyType) int {
+	if keyType == KEY_TYPE_AES128_GCM96 {
+		return AES_KEY_SIZE_128
+	}
+	return AES_KEY_SIZE_256
+}
@@ -0,0 +1,227 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/miknikif/vault-auto-unseal/helper/kwp"
+	"github.com/stretchr/testify/require"
+)
+
+// Wrap the key material for the import in the same way as the Vault clients do it
+func wrapTestKeyMaterial(t *testing.T, material []byte) string {
+	pk, err := getWrappingKey()
+	require.NoError(t, err)
+	ephemeralKey := make([]byte, EPHEMERAL_KEY_SIZE)
+	_, err = rand.Read(ephemeralKey)
+	require.NoError(t, err)
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &pk.PublicKey, ephemeralKey, nil)
+	require.NoError(t, err)
+	wrappedMaterial, err := kwp.Wrap(ephemeralKey, material)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(append(wrappedKey, wrappedMaterial...))
+}
+
+func TestBackupRestore_ImportedKey(t *testing.T) {
+	material := make([]byte, AES_KEY_SIZE_256)
+	_, err := rand.Read(material)
+	require.NoError(t, err)
+	body := fmt.Sprintf(`{"ciphertext":%q,"allow_rotation":"true","exportable":"true","allow_plaintext_backup":"true"}`, wrapTestKeyMaterial(t, material))
+	code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/imported/import", body)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+
+	w := serveRequest(http.MethodGet, "/v1/transit/backup/imported", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var backup struct {
+		Data BackupKeyResponse `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &backup))
+
+	w = serveRequest(http.MethodPost, "/v1/transit/restore/imported-restored", fmt.Sprintf(`{"backup":%q}`, backup.Data.Backup))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	restored, err := FindOneKey(&KeyModel{Name: "imported-restored"})
+	require.NoError(t, err)
+	require.True(t, restored.ImportedKey)
+	require.True(t, restored.AllowImportedKeyRotation)
+
+	rotateTestKey(t, "imported-restored")
+	code, key = performRequest(t, http.MethodGet, "/v1/transit/keys/imported-restored", "")
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.Equal(t, 2, key.Data.LatestVersion)
+}
+
+// Vault keeps the convergent version per key version, only the version 3 keys are compatible with the nonce derivation
+func TestBackupRestore_ConvergentVersion(t *testing.T) {
+	createTestKey(t, "convergent-backup", `{"derived":true,"convergent_encryption":true,"exportable":"true","allow_plaintext_backup":true}`)
+	w := serveRequest(http.MethodGet, "/v1/transit/backup/convergent-backup", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var backup struct {
+		Data BackupKeyResponse `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &backup))
+
+	bs, err := base64.StdEncoding.DecodeString(backup.Data.Backup)
+	require.NoError(t, err)
+	var data struct {
+		Policy       map[string]interface{}   `json:"policy"`
+		ArchivedKeys map[string][]interface{} `json:"archived_keys"`
+	}
+	require.NoError(t, json.Unmarshal(bs, &data))
+	require.EqualValues(t, 3, data.Policy["convergent_version"])
+	entry := data.Policy["keys"].(map[string]interface{})["1"].(map[string]interface{})
+	require.EqualValues(t, 3, entry["convergent_version"])
+
+	// Set the convergent version of the policy and of the key version, and restore the modified backup
+	restore := func(name string, policyVersion int, keyVersion int) int {
+		entry["convergent_version"] = keyVersion
+		data.Policy["convergent_version"] = policyVersion
+		data.ArchivedKeys["keys"][1] = entry
+		bs, err := json.Marshal(data)
+		require.NoError(t, err)
+		w := serveRequest(http.MethodPost, "/v1/transit/restore/"+name, fmt.Sprintf(`{"backup":%q}`, base64.StdEncoding.EncodeToString(bs)))
+		return w.Code
+	}
+	require.Equal(t, http.StatusOK, restore("convergent-v3", 3, 3))
+	require.Equal(t, http.StatusOK, restore("convergent-per-key", -1, 3))
+	require.Equal(t, http.StatusOK, restore("convergent-policy", 3, 0))
+	require.NotEqual(t, http.StatusOK, restore("convergent-v2", -1, 2))
+	require.NotEqual(t, http.StatusOK, restore("convergent-v1", 0, 0))
+
+	restored, err := FindOneKey(&KeyModel{Name: "convergent-per-key"})
+	require.NoError(t, err)
+	require.True(t, restored.ConvergentEncryption)
+	_, err = FindOneKey(&KeyModel{Name: "convergent-v2"})
+	require.Error(t, err)
+}
+
+func backupTestKey(t *testing.T, name string) string {
+	var backup BackupKeyResponse
+	code, errs := performDataRequest(t, http.MethodGet, "/v1/transit/backup/"+name, "", &backup)
+	require.Equal(t, http.StatusOK, code, errs)
+	return backup.Backup
+}
+
+// Backup keeps every version of the key and the versions config, so the old ciphertexts stay usable after the restore
+func TestBackupRestore_Versions(t *testing.T) {
+	createTestKey(t, "backup-versions", `{"exportable":true,"allow_plaintext_backup":true}`)
+	plaintext := base64.StdEncoding.EncodeToString([]byte("unseal"))
+	ciphertexts := []string{}
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			rotateTestKey(t, "backup-versions")
+		}
+		var encrypted EncryptDataResponse
+		code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/backup-versions", fmt.Sprintf(`{"plaintext":%q}`, plaintext), &encrypted)
+		require.Equal(t, http.StatusOK, code, errs)
+		ciphertexts = append(ciphertexts, encrypted.Ciphertext)
+	}
+	code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/backup-versions/config", `{"min_decryption_version":2}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+
+	code, key = performRequest(t, http.MethodPost, "/v1/transit/restore/backup-versions-restored", fmt.Sprintf(`{"backup":%q}`, backupTestKey(t, "backup-versions")))
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.Equal(t, 3, key.Data.LatestVersion)
+	require.Equal(t, 2, key.Data.MinDecryptionVersion)
+	require.Equal(t, 1, key.Data.MinEncryptionVersion)
+	require.Len(t, key.Data.Keys, 3)
+
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/backup-versions-restored", fmt.Sprintf(`{"ciphertext":%q}`, ciphertexts[0]), nil)
+	require.Equal(t, http.StatusForbidden, code)
+	require.NotEmpty(t, errs)
+	for _, ciphertext := range ciphertexts[1:] {
+		var decrypted DecryptDataResponse
+		code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/backup-versions-restored", fmt.Sprintf(`{"ciphertext":%q}`, ciphertext), &decrypted)
+		require.Equal(t, http.StatusOK, code, errs)
+		require.Equal(t, plaintext, decrypted.Plaintext)
+	}
+}
+
+// Existing key is overwritten only when the restore is forced
+func TestBackupRestore_Force(t *testing.T) {
+	createTestKey(t, "backup-source", `{"exportable":"true","allow_plaintext_backup":true}`)
+	backup := backupTestKey(t, "backup-source")
+	var encrypted EncryptDataResponse
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/backup-source", `{"plaintext":"dGVzdA=="}`, &encrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	createTestKey(t, "backup-existing", "{}")
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"backup":%q}`, backup),
+		fmt.Sprintf(`{"backup":%q,"name":"backup-existing"}`, backup),
+		fmt.Sprintf(`{"backup":%q,"name":"backup-existing","force":false}`, backup),
+	} {
+		path := "/v1/transit/restore"
+		if !strings.Contains(body, `"name"`) {
+			path += "/backup-existing"
+		}
+		code, errs = performDataRequest(t, http.MethodPost, path, body, nil)
+		require.Equal(t, http.StatusConflict, code, body)
+		require.NotEmpty(t, errs)
+	}
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/backup-existing", fmt.Sprintf(`{"ciphertext":%q}`, encrypted.Ciphertext), nil)
+	require.NotEqual(t, http.StatusOK, code, "existing key was overwritten")
+
+	for _, force := range []string{`true`, `"true"`} {
+		code, key := performRequest(t, http.MethodPost, "/v1/transit/restore/backup-existing", fmt.Sprintf(`{"backup":%q,"force":%s}`, backup, force))
+		require.Equal(t, http.StatusOK, code, key.Errors)
+		require.Equal(t, "backup-existing", key.Data.Name)
+		require.True(t, key.Data.Exportable)
+		var decrypted DecryptDataResponse
+		code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/backup-existing", fmt.Sprintf(`{"ciphertext":%q}`, encrypted.Ciphertext), &decrypted)
+		require.Equal(t, http.StatusOK, code, errs)
+		require.Equal(t, "dGVzdA==", decrypted.Plaintext)
+	}
+}
+
+// Only the exportable keys with the plaintext backup allowed could be backed up
+func TestBackupKey_NotAllowed(t *testing.T) {
+	createTestKey(t, "backup-denied", `{"exportable":true}`)
+	createTestKey(t, "backup-not-exportable", "{}")
+	for _, name := range []string{"backup-denied", "backup-not-exportable"} {
+		var backup BackupKeyResponse
+		code, errs := performDataRequest(t, http.MethodGet, "/v1/transit/backup/"+name, "", &backup)
+		require.Equal(t, http.StatusBadRequest, code, name)
+		require.NotEmpty(t, errs, name)
+		require.Empty(t, backup.Backup, name)
+	}
+	code, _ := performDataRequest(t, http.MethodGet, "/v1/transit/backup/backup-missing", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+// Flags of the import are accepted as JSON bools as well as strings
+func TestImportKey_JSONTypes(t *testing.T) {
+	material := make([]byte, AES_KEY_SIZE_256)
+	_, err := rand.Read(material)
+	require.NoError(t, err)
+	for name, flags := range map[string]string{
+		"imported-bools":   `"allow_rotation":true,"allow_plaintext_backup":true,"deletion_allowed":true,"derived":true,"exportable":true`,
+		"imported-strings": `"allow_rotation":"true","allow_plaintext_backup":"true","deletion_allowed":"true","derived":"true","exportable":"true"`,
+	} {
+		body := fmt.Sprintf(`{"ciphertext":%q,%s}`, wrapTestKeyMaterial(t, material), flags)
+		code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/"+name+"/import", body)
+		require.Equal(t, http.StatusOK, code, key.Errors)
+		require.True(t, key.Data.ImportedKey, name)
+		require.True(t, key.Data.AllowRotation, name)
+		require.True(t, key.Data.AllowPlaintextBackup, name)
+		require.True(t, key.Data.DeletionAllowed, name)
+		require.True(t, key.Data.Derived, name)
+		require.True(t, key.Data.Exportable, name)
+	}
+
+	code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/imported-defaults/import", fmt.Sprintf(`{"ciphertext":%q,"derived":false,"exportable":false}`, wrapTestKeyMaterial(t, material)))
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.False(t, key.Data.Derived)
+	require.False(t, key.Data.Exportable)
+	require.False(t, key.Data.AllowRotation)
+	code, key = performRequest(t, http.MethodPut, "/v1/transit/keys/imported-defaults/rotate", "{}")
+	require.NotEqual(t, http.StatusOK, code, "imported key rotated without allow_rotation")
+	require.NotEmpty(t, key.Errors)
+}
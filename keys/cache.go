@@ -0,0 +1,176 @@
+package keys
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Minimal size of the limited cache, the same as in Vault
+const MIN_KEY_CACHE_SIZE = 10
+
+// In-memory cache of the keys, so the encrypt and decrypt requests aren't hitting the DB every time
+// Entries are invalidated after every change of the key is committed to the DB
+// Cache is unlimited when the size is 0, otherwise the least recently used keys are evicted
+type keyCache struct {
+	lock       sync.Mutex
+	size       int
+	entries    map[string]*list.Element
+	lru        *list.List
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+// Snapshot of the cache metrics
+type KeyCacheStats struct {
+	Size    int
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+var cache = newKeyCache(0)
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Copy of the cached key, so callers can't modify the cached list of the key versions
+func copyKeyModel(keyModel KeyModel) KeyModel {
+	keyModel.Keys = append([]AESKeyModel(nil), keyModel.Keys...)
+	return keyModel
+}
+
+func (s *keyCache) get(name string) (KeyModel, uint64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if element, ok := s.entries[name]; ok {
+		atomic.AddUint64(&s.hits, 1)
+		s.lru.MoveToFront(element)
+		return copyKeyModel(element.Value.(KeyModel)), s.generation, true
+	}
+	atomic.AddUint64(&s.misses, 1)
+	return KeyModel{}, s.generation, false
+}
+
+// Key is cached only if nothing was invalidated since the key was loaded from the DB,
+// otherwise a stale key loaded right before the invalidation could be cached
+func (s *keyCache) put(keyModel KeyModel, generation uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.generation != generation {
+		return
+	}
+	if element, ok := s.entries[keyModel.Name]; ok {
+		element.Value = copyKeyModel(keyModel)
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[keyModel.Name] = s.lru.PushFront(copyKeyModel(keyModel))
+	s.evict()
+}
+
+// Drop the least recently used keys above the size of the cache
+func (s *keyCache) evict() {
+	for s.size > 0 && s.lru.Len() > s.size {
+		element := s.lru.Back()
+		s.lru.Remove(element)
+		delete(s.entries, element.Value.(KeyModel).Name)
+	}
+}
+
+func (s *keyCache) invalidate(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.generation++
+	if element, ok := s.entries[name]; ok {
+		s.lru.Remove(element)
+		delete(s.entries, name)
+	}
+}
+
+func (s *keyCache) purge() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.generation++
+	s.entries = map[string]*list.Element{}
+	s.lru.Init()
+}
+
+func (s *keyCache) resize(size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.size = size
+	s.evict()
+}
+
+func (s *keyCache) stats() KeyCacheStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return KeyCacheStats{
+		Size:    s.size,
+		Entries: len(s.entries),
+		Hits:    atomic.LoadUint64(&s.hits),
+		Misses:  atomic.LoadUint64(&s.misses),
+	}
+}
+
+// Get the key by its name, the DB is queried only if the key isn't cached yet
+func FindCachedKey(name string) (KeyModel, error) {
+	keyModel, generation, ok := cache.get(name)
+	if ok {
+		return keyModel, nil
+	}
+	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	if err != nil {
+		return keyModel, err
+	}
+	cache.put(keyModel, generation)
+	return keyModel, nil
+}
+
+// Remove all the keys from the cache, keys are loaded from the DB again on the next use
+func PurgeKeyCache() error {
+	cache.purge()
+	return nil
+}
+
+// Get the metrics of the key cache
+func GetKeyCacheStats() KeyCacheStats {
+	return cache.stats()
+}
+
+// Apply the saved size of the cache, the cache is unlimited if the size was never configured
+func LoadKeyCacheConfig() error {
+	config, err := FindKeyCacheConfig()
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	cache.resize(config.Size)
+	return nil
+}
+
+// Save the size of the cache and apply it right away
+func SetKeyCacheSize(size int) error {
+	if size != 0 && size < MIN_KEY_CACHE_SIZE {
+		return fmt.Errorf("size must be 0 or a value greater or equal to %d", MIN_KEY_CACHE_SIZE)
+	}
+	config, err := FindKeyCacheConfig()
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	config.Size = size
+	if err := SaveOne(&config); err != nil {
+		return err
+	}
+	cache.resize(size)
+	return nil
+}
@@ -0,0 +1,223 @@
+package keys
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testEncryptResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Version    int    `json:"version"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+func encryptTestData(name string) (int, testEncryptResponse) {
+	var res testEncryptResponse
+	w := serveRequest(http.MethodPut, "/v1/transit/encrypt/"+name, `{"plaintext":"dGVzdA=="}`)
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return w.Code, res
+}
+
+func TestKeyCache_StaleLoad(t *testing.T) {
+	c := newKeyCache(0)
+
+	_, generation, ok := c.get("stale")
+	require.False(t, ok)
+	c.invalidate("stale")
+	c.put(KeyModel{Name: "stale", LatestVersion: 1}, generation)
+	_, _, ok = c.get("stale")
+	require.False(t, ok, "key loaded before the invalidation shouldn't be cached")
+
+	_, generation, _ = c.get("stale")
+	c.put(KeyModel{Name: "stale", LatestVersion: 2}, generation)
+	keyModel, _, ok := c.get("stale")
+	require.True(t, ok)
+	require.Equal(t, 2, keyModel.LatestVersion)
+
+	stats := c.stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(3), stats.Misses)
+}
+
+func TestKeyCache_CopiesKeys(t *testing.T) {
+	c := newKeyCache(0)
+	c.put(KeyModel{Name: "copy", Keys: make([]AESKeyModel, 1, 2)}, 0)
+
+	keyModel, _, _ := c.get("copy")
+	keyModel.Keys[0].Version = 5
+	keyModel.Keys = append(keyModel.Keys, AESKeyModel{Version: 6})
+
+	cached, _, _ := c.get("copy")
+	require.Len(t, cached.Keys, 1)
+	require.Equal(t, 0, cached.Keys[0].Version)
+}
+
+func TestKeyCache_Eviction(t *testing.T) {
+	c := newKeyCache(2)
+	for _, name := range []string{"first", "second"} {
+		_, generation, _ := c.get(name)
+		c.put(KeyModel{Name: name}, generation)
+	}
+	// First key is used recently, so the second one is evicted
+	_, _, ok := c.get("first")
+	require.True(t, ok)
+	_, generation, _ := c.get("third")
+	c.put(KeyModel{Name: "third"}, generation)
+
+	_, _, ok = c.get("second")
+	require.False(t, ok)
+	for _, name := range []string{"first", "third"} {
+		_, _, ok = c.get(name)
+		require.True(t, ok, name)
+	}
+
+	c.resize(1)
+	require.Equal(t, 1, c.stats().Entries)
+	_, _, ok = c.get("third")
+	require.True(t, ok)
+
+	c.resize(0)
+	for _, name := range []string{"first", "second"} {
+		_, generation, _ := c.get(name)
+		c.put(KeyModel{Name: name}, generation)
+	}
+	require.Equal(t, 3, c.stats().Entries)
+}
+
+// Cache config uses the same format as Vault, metrics are served on the separate path
+func TestKeyCacheConfig(t *testing.T) {
+	w := serveRequest(http.MethodGet, "/v1/transit/cache-config", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"size":0}`, string(dataOf(t, w.Body.Bytes())))
+
+	for _, body := range []string{`{"size":5}`, `{"size":-1}`, `{"size":"big"}`} {
+		w = serveRequest(http.MethodPost, "/v1/transit/cache-config", body)
+		require.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w = serveRequest(http.MethodPost, "/v1/transit/cache-config", `{"size":20}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serveRequest(http.MethodGet, "/v1/transit/cache-config", "")
+	require.JSONEq(t, `{"size":20}`, string(dataOf(t, w.Body.Bytes())))
+	config, err := FindKeyCacheConfig()
+	require.NoError(t, err)
+	require.Equal(t, 20, config.Size)
+
+	w = serveRequest(http.MethodGet, "/v1/transit/cache-stats", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stats map[string]interface{}
+	require.NoError(t, json.Unmarshal(dataOf(t, w.Body.Bytes()), &stats))
+	require.Equal(t, float64(20), stats["size"])
+	require.Contains(t, stats, "hits")
+	require.Contains(t, stats, "misses")
+
+	w = serveRequest(http.MethodPut, "/v1/transit/cache-config", `{"size":"0"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, 0, GetKeyCacheStats().Size)
+}
+
+func dataOf(t *testing.T, body []byte) json.RawMessage {
+	var res struct {
+		Data json.RawMessage `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(body, &res))
+	return res.Data
+}
+
+func TestKeyCache_Invalidation(t *testing.T) {
+	createTestKey(t, "cached", `{"deletion_allowed":"true"}`)
+	before := GetKeyCacheStats()
+
+	for i := 0; i < 3; i++ {
+		code, res := encryptTestData("cached")
+		require.Equal(t, http.StatusOK, code, res.Errors)
+		require.Equal(t, 1, res.Data.Version)
+	}
+	after := GetKeyCacheStats()
+	require.Equal(t, before.Misses+1, after.Misses)
+	require.Equal(t, before.Hits+2, after.Hits)
+
+	rotateTestKey(t, "cached")
+	code, res := encryptTestData("cached")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, 2, res.Data.Version)
+
+	code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/cached/config", `{"min_encryption_version":"2","min_decryption_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	code, key = performRequest(t, http.MethodGet, "/v1/transit/keys/cached", "")
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.Equal(t, 2, key.Data.MinDecryptionVersion)
+
+	code, key = performRequest(t, http.MethodPost, "/v1/transit/keys/cached/trim", `{"min_available_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	code, key = performRequest(t, http.MethodGet, "/v1/transit/keys/cached", "")
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.Equal(t, 2, key.Data.MinAvailableVersion)
+	require.Len(t, key.Data.Keys, 1)
+
+	code, _ = performRequest(t, http.MethodDelete, "/v1/transit/keys/cached", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = encryptTestData("cached")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+// Every ciphertext produced while the key is rotated should be decryptable,
+// and the latest version should be used once the rotations are done
+func TestKeyCache_ConcurrentRotateEncrypt(t *testing.T) {
+	const rotations = 12
+	const encryptions = 50
+	createTestKey(t, "concurrent", "{}")
+
+	var wg sync.WaitGroup
+	errs := make(chan string, rotations+encryptions)
+	ciphertexts := make(chan string, encryptions)
+	for i := 0; i < rotations; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serveRequest(http.MethodPut, "/v1/transit/keys/concurrent/rotate", ""); w.Code != http.StatusOK {
+				errs <- fmt.Sprintf("rotate: %d %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	for i := 0; i < encryptions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, res := encryptTestData("concurrent")
+			if code != http.StatusOK {
+				errs <- fmt.Sprintf("encrypt: %d %v", code, res.Errors)
+				return
+			}
+			ciphertexts <- res.Data.Ciphertext
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(ciphertexts)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for ct := range ciphertexts {
+		w := serveRequest(http.MethodPut, "/v1/transit/decrypt/concurrent", fmt.Sprintf(`{"ciphertext":%q}`, ct))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+
+	code, key := performRequest(t, http.MethodGet, "/v1/transit/keys/concurrent", "")
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	require.Equal(t, rotations+1, key.Data.LatestVersion)
+	require.Len(t, key.Data.Keys, rotations+1)
+
+	code, res := encryptTestData("concurrent")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, rotations+1, res.Data.Version)
+}
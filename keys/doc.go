@@ -5,6 +5,14 @@ model.go: definition of orm based data model
 
 routers.go: router binding and core logic
 
+rotation.go: manual and automatic key rotation
+
+cache.go: in-memory cache of the keys used by the transit operations
+
+backup.go: plaintext backup and restore of the keys in the Vault format
+
+import.go: import of the wrapped key material (BYOK)
+
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
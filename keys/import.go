@@ -0,0 +1,165 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/helper/kwp"
+)
+
+const (
+	WRAPPING_KEY_BITS      = RSA_KEY_BITS_4096
+	EPHEMERAL_KEY_SIZE     = AES_KEY_SIZE_256
+	DEFAULT_IMPORT_HASH_FN = "SHA256"
+	IMPORT_HASH_FN_SHA1    = "SHA1"
+	IMPORT_HASH_FN_SHA224  = "SHA224"
+	IMPORT_HASH_FN_SHA256  = "SHA256"
+	IMPORT_HASH_FN_SHA384  = "SHA384"
+	IMPORT_HASH_FN_SHA512  = "SHA512"
+)
+
+// Hash functions which could be used for the RSA-OAEP wrapping of the ephemeral key
+var importHashFunctions = map[string]crypto.Hash{
+	IMPORT_HASH_FN_SHA1:   crypto.SHA1,
+	IMPORT_HASH_FN_SHA224: crypto.SHA224,
+	IMPORT_HASH_FN_SHA256: crypto.SHA256,
+	IMPORT_HASH_FN_SHA384: crypto.SHA384,
+	IMPORT_HASH_FN_SHA512: crypto.SHA512,
+}
+
+// Wrapping key is generated only once, concurrent requests are waiting for it
+var wrappingKeyLock sync.Mutex
+
+// Get the hash function used for the RSA-OAEP, SHA256 is used by default
+func getImportHashFunction(name string) (crypto.Hash, error) {
+	if name == "" {
+		name = DEFAULT_IMPORT_HASH_FN
+	}
+	hash, ok := importHashFunctions[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hash_function %q", name)
+	}
+	return hash, nil
+}
+
+// Get the wrapping key, it's generated on the first use
+func getWrappingKey() (*rsa.PrivateKey, error) {
+	wrappingKeyLock.Lock()
+	defer wrappingKeyLock.Unlock()
+
+	model, err := FindWrappingKey()
+	if gorm.IsRecordNotFoundError(err) {
+		model.AESKey, err = generateRSAKey(WRAPPING_KEY_BITS)
+		if err != nil {
+			return nil, err
+		}
+		err = SaveOne(&model)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return model.AESKey.decodeRSA()
+}
+
+// Get the public part of the wrapping key in the PEM format
+func getWrappingPublicKey() (string, error) {
+	pk, err := getWrappingKey()
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&pk.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: PUBLIC_KEY_PEM_TYPE, Bytes: der})), nil
+}
+
+// Unwrap the imported key material in the same way as Vault does it
+// Ciphertext is the ephemeral AES key wrapped with RSA-OAEP, followed by the key material wrapped with AES-KWP
+func unwrapKeyMaterial(ciphertext []byte, hash crypto.Hash) ([]byte, error) {
+	pk, err := getWrappingKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) <= pk.Size() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	ephemeralKey, err := rsa.DecryptOAEP(hash.New(), rand.Reader, pk, ciphertext[:pk.Size()], nil)
+	if err != nil {
+		return nil, errors.New("unable to unwrap the ephemeral key")
+	}
+	if len(ephemeralKey) != EPHEMERAL_KEY_SIZE {
+		return nil, errors.New("ephemeral key should be an AES-256 key")
+	}
+	material, err := kwp.Unwrap(ephemeralKey, ciphertext[pk.Size():])
+	if err != nil {
+		return nil, errors.New("unable to unwrap the key material")
+	}
+	return material, nil
+}
+
+// Create the version of the key from the imported key material
+// Symmetric keys are imported as raw bytes, key pairs as PKCS8 DER
+func importKeyVersion(keyType KeyType, material []byte, ver int) (AESKeyModel, error) {
+	var key AESKey
+	if !keyType.IsAsymmetric() {
+		if len(material) != symmetricKeySize(keyType) {
+			return AESKeyModel{}, fmt.Errorf("imported key should be %d bytes long for the %s keys", symmetricKeySize(keyType), keyType)
+		}
+		key = AESKey(hex.EncodeToString(material))
+	} else {
+		pk, err := x509.ParsePKCS8PrivateKey(material)
+		if err != nil {
+			return AESKeyModel{}, errors.New("imported key should be a PKCS8 encoded private key")
+		}
+		if err := checkImportedKeyType(keyType, pk); err != nil {
+			return AESKeyModel{}, err
+		}
+		if rsaKey, ok := pk.(*rsa.PrivateKey); ok {
+			key = AESKey(hex.EncodeToString(x509.MarshalPKCS1PrivateKey(rsaKey)))
+		} else if key, err = marshalPrivateKey(pk); err != nil {
+			return AESKeyModel{}, err
+		}
+	}
+	hmacKey, err := generateAESKey(HMAC_KEY_SIZE)
+	if err != nil {
+		return AESKeyModel{}, err
+	}
+	return AESKeyModel{
+		Name:    int(time.Now().Unix()),
+		Version: ver,
+		AESKey:  key,
+		HMACKey: hmacKey,
+	}, nil
+}
+
+// Check if the imported private key matches the type of the key
+func checkImportedKeyType(keyType KeyType, pk interface{}) error {
+	valid := false
+	switch k := pk.(type) {
+	case *rsa.PrivateKey:
+		valid = keyType.IsRSA() && fmt.Sprintf("rsa-%d", k.N.BitLen()) == string(keyType)
+	case ed25519.PrivateKey:
+		valid = keyType == KEY_TYPE_ED25519
+	case *ecdsa.PrivateKey:
+		valid = (keyType == KEY_TYPE_ECDSA_P256 && k.Curve == elliptic.P256()) ||
+			(keyType == KEY_TYPE_ECDSA_P384 && k.Curve == elliptic.P384())
+	}
+	if !valid {
+		return fmt.Errorf("imported key doesn't match the %s key type", keyType)
+	}
+	return nil
+}
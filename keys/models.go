@@ -1,25 +1,87 @@
 package keys
 
 import (
+	"crypto"
+	"encoding/base64"
 	"errors"
 	"fmt"
 
 	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/barrier"
 	"github.com/miknikif/vault-auto-unseal/common"
 )
 
 type KeyType string
 
 const (
-	KEY_TYPE_AES256_GCM96 KeyType = "aes256-gcm96"
+	KEY_TYPE_AES128_GCM96      KeyType = "aes128-gcm96"
+	KEY_TYPE_AES256_GCM96      KeyType = "aes256-gcm96"
+	KEY_TYPE_CHACHA20_POLY1305 KeyType = "chacha20-poly1305"
+	KEY_TYPE_RSA_2048          KeyType = "rsa-2048"
+	KEY_TYPE_RSA_3072          KeyType = "rsa-3072"
+	KEY_TYPE_RSA_4096          KeyType = "rsa-4096"
+	KEY_TYPE_ED25519           KeyType = "ed25519"
+	KEY_TYPE_ECDSA_P256        KeyType = "ecdsa-p256"
+	KEY_TYPE_ECDSA_P384        KeyType = "ecdsa-p384"
 )
 
+// Check if the key type is one of the supported ones
+func (t KeyType) IsValid() bool {
+	switch t {
+	case KEY_TYPE_AES128_GCM96, KEY_TYPE_AES256_GCM96, KEY_TYPE_CHACHA20_POLY1305,
+		KEY_TYPE_RSA_2048, KEY_TYPE_RSA_3072, KEY_TYPE_RSA_4096,
+		KEY_TYPE_ED25519, KEY_TYPE_ECDSA_P256, KEY_TYPE_ECDSA_P384:
+		return true
+	}
+	return false
+}
+
+// Check if the key type is backed by the RSA key pair
+func (t KeyType) IsRSA() bool {
+	return t == KEY_TYPE_RSA_2048 || t == KEY_TYPE_RSA_3072 || t == KEY_TYPE_RSA_4096
+}
+
+// Check if the key type is backed by the key pair
+func (t KeyType) IsAsymmetric() bool {
+	return t.IsRSA() || t == KEY_TYPE_ED25519 || t == KEY_TYPE_ECDSA_P256 || t == KEY_TYPE_ECDSA_P384
+}
+
+// Symmetric and RSA keys are able to encrypt and decrypt data
+func (t KeyType) SupportsEncryption() bool {
+	return t.IsValid() && (!t.IsAsymmetric() || t.IsRSA())
+}
+
+// Name of the key pair reported alongside with its public key
+func (t KeyType) publicKeyName() string {
+	switch t {
+	case KEY_TYPE_ECDSA_P256:
+		return "P-256"
+	case KEY_TYPE_ECDSA_P384:
+		return "P-384"
+	}
+	return string(t)
+}
+
+// Only the symmetric keys are able to derive per-context subkeys
+func (t KeyType) SupportsDerivation() bool {
+	return t.IsValid() && !t.IsAsymmetric()
+}
+
+// Only the key pairs are able to sign data and verify signatures
+func (t KeyType) SupportsSigning() bool {
+	return t.IsAsymmetric()
+}
+
+// Single version of the key
+// AESKey holds the hex encoded key material of any key type (PKCS1 DER for RSA keys)
+// HMACKey holds the hex encoded key used by the HMAC endpoints, it's generated for all key types
 type AESKeyModel struct {
 	gorm.Model
 	KeyID   uint
 	Name    int
 	Version int `gorm:"uniqueIndex:keynamever;"`
 	AESKey  AESKey
+	HMACKey AESKey
 }
 
 type KeyModel struct {
@@ -32,23 +94,74 @@ type KeyModel struct {
 	AutoRotatePeriod     int
 	DeletionAllowed      bool
 	Derived              bool
+	ConvergentEncryption bool
 	Exportable           bool
 	ImportedKey          bool
-	LatestVersion        int
-	MinAvailableVersion  int
-	MinDecryptionVersion int
-	MinEncryptionVersion int
-	SupportsDecryption   bool
-	SupportsDerivation   bool
-	SupportsEncryption   bool
-	SupportsSigning      bool
+	// Imported keys could be rotated only if it was explicitly allowed during the import
+	AllowImportedKeyRotation bool
+	LatestVersion            int
+	MinAvailableVersion      int
+	MinDecryptionVersion     int
+	MinEncryptionVersion     int
+	SupportsDecryption       bool
+	SupportsDerivation       bool
+	SupportsEncryption       bool
+	SupportsSigning          bool
+}
+
+// RSA key pair used to wrap the key material for the import
+// AESKey holds the hex encoded PKCS1 DER of the private key
+type WrappingKeyModel struct {
+	gorm.Model
+	AESKey AESKey
 }
 
+// Single row table with the size of the key cache, configured with the transit/cache-config endpoint
+type KeyCacheConfigModel struct {
+	gorm.Model
+	Size int
+}
+
+// Version is the version of the ciphertext, KeyVersion is the version requested for encryption (0 - latest)
 type AESPayload struct {
-	Plaintext string
-	Pref      string
-	Version   int
-	Payload   string
+	Plaintext      string
+	Context        string
+	AssociatedData string
+	KeyVersion     int
+	Pref           string
+	Version        int
+	Payload        string
+}
+
+// Single item of the batch request, error is reported per item
+type BatchItem struct {
+	AESPayload
+	Reference string
+	Error     error
+}
+
+type SignPayload struct {
+	Input              string
+	HashAlgorithm      crypto.Hash
+	SignatureAlgorithm string
+	Prehashed          bool
+	Version            int
+	Signature          string
+	Valid              bool
+}
+
+type HMACPayload struct {
+	Input         string
+	HashAlgorithm crypto.Hash
+	Version       int
+	HMAC          string
+}
+
+type HashPayload struct {
+	Input         string
+	HashAlgorithm crypto.Hash
+	Format        string
+	Sum           string
 }
 
 func (s *AESPayload) validatePlaintext() error {
@@ -64,6 +177,26 @@ func (s *AESPayload) validatePlaintext() error {
 	return nil
 }
 
+func (s *AESPayload) validateContext() error {
+	if s.Context == "" {
+		return nil
+	}
+	if _, err := common.DecFromB64(s.Context); err != nil {
+		return errors.New("context should be b64 encoded")
+	}
+	return nil
+}
+
+func (s *AESPayload) validateAssociatedData() error {
+	if s.AssociatedData == "" {
+		return nil
+	}
+	if _, err := common.DecFromB64(s.AssociatedData); err != nil {
+		return errors.New("associated_data should be b64 encoded")
+	}
+	return nil
+}
+
 func (s *AESPayload) validateCiphertext() error {
 	if s.Pref == "" {
 		return errors.New("ciphertext prefix is empty")
@@ -84,6 +217,48 @@ func (s *AESPayload) getCiphertext() (string, error) {
 	return fmt.Sprintf("%s:v%d:%s", s.Pref, s.Version, s.Payload), nil
 }
 
+// Wrap the key material with the master key before it's written to the DB
+func (s *AESKeyModel) BeforeSave() error {
+	for _, key := range []*AESKey{&s.AESKey, &s.HMACKey} {
+		if *key == "" || barrier.IsWrapped(string(*key)) {
+			continue
+		}
+		wrapped, err := barrier.Wrap([]byte(*key))
+		if err != nil {
+			return err
+		}
+		*key = AESKey(wrapped)
+	}
+	return nil
+}
+
+// Wrap the key material with the master key before it's written to the DB
+func (s *WrappingKeyModel) BeforeSave() error {
+	if barrier.IsWrapped(string(s.AESKey)) {
+		return nil
+	}
+	wrapped, err := barrier.Wrap([]byte(s.AESKey))
+	if err != nil {
+		return err
+	}
+	s.AESKey = AESKey(wrapped)
+	return nil
+}
+
+func (s *SignPayload) validateInput() error {
+	if s.Input == "" {
+		return errors.New("input is empty")
+	}
+	if _, err := common.DecFromB64(s.Input); err != nil {
+		return errors.New("input should be b64 encoded")
+	}
+	return nil
+}
+
+func (s *SignPayload) getSignature(sig []byte) string {
+	return fmt.Sprintf("%s%d:%s", VERSIONED_PREFIX, s.Version, base64.StdEncoding.EncodeToString(sig))
+}
+
 func (s *KeyModel) Update(data interface{}) error {
 	l, err := common.GetLogger()
 	if err != nil {
@@ -94,10 +269,85 @@ func (s *KeyModel) Update(data interface{}) error {
 	if err != nil {
 		return err
 	}
-	err = db.Model(s).Update(data).Error
+	defer cache.invalidate(s.Name)
+	// Keys are saved separately, stale associations shouldn't be written back with the config
+	err = db.Model(s).Set("gorm:save_associations", false).Updates(data).Error
 	return err
 }
 
+// Permanently delete versions of the key below the min available version
+// secure_delete makes SQLite overwrite the deleted key material instead of just unlinking it
+func (s *KeyModel) Trim(minAvailableVersion int) error {
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Trimming KeyModel", "name", s.Name, "min_available_version", minAvailableVersion)
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+	defer cache.invalidate(s.Name)
+	// Keys are filtered first, otherwise saving of the associations would recreate the deleted versions
+	keys := []AESKeyModel{}
+	for _, key := range s.Keys {
+		if key.Version >= minAvailableVersion {
+			keys = append(keys, key)
+		}
+	}
+	s.Keys = keys
+
+	tx := db.Begin()
+	if err := tx.Exec("PRAGMA secure_delete = ON").Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Unscoped().Where("key_id = ? AND version < ?", s.ID, minAvailableVersion).Delete(AESKeyModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(s).Update("min_available_version", minAvailableVersion).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Save the restored key, the existing key with the same name is permanently deleted first
+func RestoreKeyModel(existing *KeyModel, restored *KeyModel) error {
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Restoring KeyModel", "name", restored.Name, "overwrite", existing.ID != 0)
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+	defer cache.invalidate(restored.Name)
+
+	tx := db.Begin()
+	if existing.ID != 0 {
+		if err := tx.Exec("PRAGMA secure_delete = ON").Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Unscoped().Where("key_id = ?", existing.ID).Delete(AESKeyModel{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Unscoped().Delete(existing).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Save(restored).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 func SaveOne(data interface{}) error {
 	l, err := common.GetLogger()
 	if err != nil {
@@ -112,6 +362,12 @@ func SaveOne(data interface{}) error {
 	return err
 }
 
+// Save the key and drop it from the cache once the changes are committed
+func SaveKeyModel(keyModel *KeyModel) error {
+	defer cache.invalidate(keyModel.Name)
+	return SaveOne(keyModel)
+}
+
 func FindOneKey(condition interface{}) (KeyModel, error) {
 	var model KeyModel
 	l, err := common.GetLogger()
@@ -128,6 +384,36 @@ func FindOneKey(condition interface{}) (KeyModel, error) {
 	return model, err
 }
 
+func FindWrappingKey() (WrappingKeyModel, error) {
+	var model WrappingKeyModel
+	l, err := common.GetLogger()
+	if err != nil {
+		return model, err
+	}
+	l.Debug("Starting retrieval of the WrappingKeyModel from the DB")
+	db, err := common.GetDB()
+	if err != nil {
+		return model, err
+	}
+	err = db.First(&model).Error
+	return model, err
+}
+
+func FindKeyCacheConfig() (KeyCacheConfigModel, error) {
+	var model KeyCacheConfigModel
+	l, err := common.GetLogger()
+	if err != nil {
+		return model, err
+	}
+	l.Debug("Starting retrieval of the KeyCacheConfigModel from the DB")
+	db, err := common.GetDB()
+	if err != nil {
+		return model, err
+	}
+	err = db.First(&model).Error
+	return model, err
+}
+
 func FindManyKeys() ([]KeyModel, int64, error) {
 	var models []KeyModel
 	var count int64
@@ -156,6 +442,7 @@ func DeleteAESKeyModel(condition interface{}) error {
 	if err != nil {
 		return err
 	}
+	defer cache.purge()
 	err = db.Where(condition).Delete(AESKeyModel{}).Error
 	return err
 }
@@ -170,6 +457,72 @@ func DeleteKeyModel(condition interface{}) error {
 	if err != nil {
 		return err
 	}
+	// Keys are deleted rarely, so the whole cache is dropped instead of matching the condition
+	defer cache.purge()
 	err = db.Where(condition).Delete(KeyModel{}).Error
 	return err
 }
+
+// Wrap key material which was saved to the DB before the master key was introduced
+func WrapPlaintextKeys() error {
+	var models []AESKeyModel
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Starting wrapping of the plaintext AESKeyModels")
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+	if err := db.Find(&models).Error; err != nil {
+		return err
+	}
+	wrapped := 0
+	for _, model := range models {
+		if barrier.IsWrapped(string(model.AESKey)) {
+			continue
+		}
+		if err := SaveOne(&model); err != nil {
+			return err
+		}
+		wrapped++
+	}
+	if wrapped > 0 {
+		l.Warn("Wrapped plaintext key material with the master key", "count", wrapped)
+	}
+	l.Debug("Finished wrapping of the plaintext AESKeyModels")
+	return nil
+}
+
+// Generate HMAC keys for the key versions created before the HMAC endpoints were introduced
+func GenerateMissingHMACKeys() error {
+	var models []AESKeyModel
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	l.Debug("Starting generation of the missing HMAC keys")
+	db, err := common.GetDB()
+	if err != nil {
+		return err
+	}
+	if err := db.Where("hmac_key = ? OR hmac_key IS NULL", "").Find(&models).Error; err != nil {
+		return err
+	}
+	for _, model := range models {
+		key, err := generateAESKey(HMAC_KEY_SIZE)
+		if err != nil {
+			return err
+		}
+		model.HMACKey = key
+		if err := SaveOne(&model); err != nil {
+			return err
+		}
+	}
+	if len(models) > 0 {
+		l.Info("Generated missing HMAC keys", "count", len(models))
+	}
+	l.Debug("Finished generation of the missing HMAC keys")
+	return nil
+}
@@ -0,0 +1,118 @@
+package keys
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/barrier"
+	"github.com/miknikif/vault-auto-unseal/common"
+)
+
+const (
+	AUTO_ROTATE_CHECK_INTERVAL = time.Minute
+	MIN_AUTO_ROTATE_PERIOD     = 60 * 60
+)
+
+// Rotations are serialized, so concurrent manual and automatic rotations
+// aren't creating the same version of the key twice
+var rotateLock sync.Mutex
+
+// Add a new version of the key material to the already loaded key
+// rotateLock should be held by the caller
+func rotateKeyModel(keyModel *KeyModel) error {
+	if keyModel.ImportedKey && !keyModel.AllowImportedKeyRotation {
+		return errors.New("imported key can't be rotated, rotation wasn't allowed during the import")
+	}
+	key, err := createNewKeyVersion(keyModel.Type, keyModel.LatestVersion+1)
+	if err != nil {
+		return err
+	}
+	keyModel.Keys = append(keyModel.Keys, key)
+	keyModel.LatestVersion = key.Version
+	return SaveKeyModel(keyModel)
+}
+
+// Rotate the key with the provided name
+func rotateKey(name string) (KeyModel, error) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+
+	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	if err != nil {
+		return keyModel, err
+	}
+	if err := rotateKeyModel(&keyModel); err != nil {
+		return keyModel, err
+	}
+	return keyModel, nil
+}
+
+// Check if the latest version of the key is older than its auto_rotate_period
+func isRotationDue(keyModel KeyModel, now time.Time) bool {
+	if keyModel.AutoRotatePeriod <= 0 {
+		return false
+	}
+	latest, err := findKeyVersion(keyModel.Keys, keyModel.LatestVersion)
+	if err != nil {
+		return false
+	}
+	created := time.Unix(int64(latest.Name), 0)
+	return now.Sub(created) >= time.Duration(keyModel.AutoRotatePeriod)*time.Second
+}
+
+// Single check of the automatic rotation, nothing is rotated while the server is sealed
+func autoRotateKeys(now time.Time, sealed bool) error {
+	if sealed {
+		return nil
+	}
+	return rotateExpiredKeys(now)
+}
+
+// Rotate all the keys whose latest version is older than their auto_rotate_period
+// The key is loaded again under the lock, so a manual rotation which happened in between is respected
+func rotateExpiredKeys(now time.Time) error {
+	l, err := common.GetLogger()
+	if err != nil {
+		return err
+	}
+	keyModels, _, err := FindManyKeys()
+	if err != nil {
+		return err
+	}
+	for _, model := range keyModels {
+		if model.AutoRotatePeriod <= 0 {
+			continue
+		}
+		rotateLock.Lock()
+		keyModel, err := FindOneKey(&KeyModel{Name: model.Name})
+		if gorm.IsRecordNotFoundError(err) {
+			err = nil
+		} else if err == nil && isRotationDue(keyModel, now) {
+			if err = rotateKeyModel(&keyModel); err == nil {
+				l.Info("Key was rotated automatically", "name", keyModel.Name, "version", keyModel.LatestVersion, "auto_rotate_period", keyModel.AutoRotatePeriod)
+			}
+		}
+		rotateLock.Unlock()
+		if err != nil {
+			l.Error("Unable to rotate the key automatically", "name", model.Name, "error", err)
+		}
+	}
+	return nil
+}
+
+// Periodically rotate keys based on their auto_rotate_period
+// Nothing is rotated while the server is sealed
+func StartAutoRotation(interval time.Duration) {
+	l, _ := common.GetLogger()
+	l.Debug("Starting automatic key rotation", "interval", interval)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for now := range ticker.C {
+			if err := autoRotateKeys(now, barrier.IsSealed()); err != nil {
+				l.Error("Automatic key rotation failed", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,82 @@
+package keys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func latestTestKeyVersion(t *testing.T, name string) int {
+	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	require.NoError(t, err)
+	return keyModel.LatestVersion
+}
+
+// Clock is moved forward instead of waiting for the auto_rotate_period to pass
+func TestAutoRotateKeys(t *testing.T) {
+	createTestKey(t, "auto-hourly", `{"auto_rotate_period":"1h"}`)
+	createTestKey(t, "auto-daily", `{"auto_rotate_period":"24h"}`)
+	createTestKey(t, "auto-disabled", `{"auto_rotate_period":"0"}`)
+	now := time.Now()
+
+	require.NoError(t, autoRotateKeys(now.Add(2*time.Hour), true))
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-hourly"), "rotated while sealed")
+
+	require.NoError(t, autoRotateKeys(now.Add(30*time.Minute), false))
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-hourly"), "rotated before the period")
+
+	require.NoError(t, autoRotateKeys(now.Add(2*time.Hour), false))
+	require.Equal(t, 2, latestTestKeyVersion(t, "auto-hourly"))
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-daily"))
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-disabled"))
+
+	// New version is created with the real clock, so its period starts again
+	require.NoError(t, autoRotateKeys(now.Add(30*time.Minute), false))
+	require.Equal(t, 2, latestTestKeyVersion(t, "auto-hourly"))
+
+	require.NoError(t, autoRotateKeys(now.Add(25*time.Hour), false))
+	require.Equal(t, 3, latestTestKeyVersion(t, "auto-hourly"))
+	require.Equal(t, 2, latestTestKeyVersion(t, "auto-daily"))
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-disabled"))
+}
+
+// Automatic rotation waits for the manual rotation and loads the key again, so the key isn't rotated twice
+func TestAutoRotateKeys_RotateLock(t *testing.T) {
+	createTestKey(t, "auto-locked", `{"auto_rotate_period":"1h"}`)
+	keyModel, err := FindOneKey(&KeyModel{Name: "auto-locked"})
+	require.NoError(t, err)
+	conf, err := common.GetConfig()
+	require.NoError(t, err)
+	created := time.Now().Add(-2 * time.Hour).Unix()
+	require.NoError(t, conf.DB.Model(&AESKeyModel{}).Where("key_id = ? AND version = ?", keyModel.ID, 1).Update("name", created).Error)
+	keyModel, err = FindOneKey(&KeyModel{Name: "auto-locked"})
+	require.NoError(t, err)
+	require.True(t, isRotationDue(keyModel, time.Now()))
+
+	rotateLock.Lock()
+	done := make(chan error)
+	go func() {
+		done <- autoRotateKeys(time.Now(), false)
+	}()
+	select {
+	case err := <-done:
+		rotateLock.Unlock()
+		t.Fatalf("automatic rotation didn't wait for the lock: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Equal(t, 1, latestTestKeyVersion(t, "auto-locked"))
+
+	// Manual rotation holding the lock
+	keyModel, err = FindOneKey(&KeyModel{Name: "auto-locked"})
+	require.NoError(t, err)
+	require.NoError(t, rotateKeyModel(&keyModel))
+	rotateLock.Unlock()
+	require.NoError(t, <-done)
+
+	keyModel, err = FindOneKey(&KeyModel{Name: "auto-locked"})
+	require.NoError(t, err)
+	require.Equal(t, 2, keyModel.LatestVersion)
+	require.Len(t, keyModel.Keys, 2)
+}
@@ -4,15 +4,49 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/barrier"
 	"github.com/miknikif/vault-auto-unseal/common"
 )
 
 func KeysOperationsRegister(router *gin.RouterGroup) {
+	router.Use(barrier.SealedMiddleware())
 	router.PUT("/encrypt/:name", EncryptData)
 	router.PUT("/decrypt/:name", DecryptData)
 	router.PUT("/rewrap/:name", RewrapData)
+	router.POST("/sign/:name", SignData)
+	router.PUT("/sign/:name", SignData)
+	router.POST("/sign/:name/:hash_algorithm", SignData)
+	router.PUT("/sign/:name/:hash_algorithm", SignData)
+	router.POST("/hmac/:name", HMACData)
+	router.PUT("/hmac/:name", HMACData)
+	router.POST("/hmac/:name/:algorithm", HMACData)
+	router.PUT("/hmac/:name/:algorithm", HMACData)
+	router.POST("/hash", HashData)
+	router.PUT("/hash", HashData)
+	router.POST("/hash/:algorithm", HashData)
+	router.PUT("/hash/:algorithm", HashData)
+	router.POST("/verify/:name", VerifyData)
+	router.PUT("/verify/:name", VerifyData)
+	router.POST("/verify/:name/:hash_algorithm", VerifyData)
+	router.PUT("/verify/:name/:hash_algorithm", VerifyData)
+	router.POST("/datakey/:type/:name", DataKey)
+	router.PUT("/datakey/:type/:name", DataKey)
+	router.GET("/export/:type/:name", ExportKey)
+	router.GET("/export/:type/:name/:version", ExportKey)
+	router.GET("/backup/:name", BackupKey)
+	router.GET("/wrapping_key", WrappingKey)
+	router.GET("/cache-config", KeyCacheConfigRetrieve)
+	router.POST("/cache-config", KeyCacheConfigUpdate)
+	router.PUT("/cache-config", KeyCacheConfigUpdate)
+	router.GET("/cache-stats", KeyCacheStatsRetrieve)
+	router.POST("/restore", RestoreKey)
+	router.PUT("/restore", RestoreKey)
+	router.POST("/restore/:name", RestoreKey)
+	router.PUT("/restore/:name", RestoreKey)
 	KeysRegister(router.Group("/keys"))
 }
 
@@ -23,13 +57,26 @@ func KeysRegister(router *gin.RouterGroup) {
 	router.DELETE("/:name", KeyDelete)
 	router.PUT("/:name/config", KeyUpdate)
 	router.PUT("/:name/rotate", KeyRotate)
+	router.POST("/:name/trim", KeyTrim)
+	router.PUT("/:name/trim", KeyTrim)
+	router.POST("/:name/import", KeyImport)
+	router.PUT("/:name/import", KeyImport)
+	router.POST("/:name/import_version", KeyImportVersion)
+	router.PUT("/:name/import_version", KeyImportVersion)
+	common.RegisterExistenceCheck(router.BasePath()+"/:name", KeyExistenceCheck)
+	common.RegisterExistenceCheck(router.BasePath()+"/:name/import", KeyExistenceCheck)
 }
 
-func KeyCreate(c *gin.Context) {
-	if allowed := common.VerifyCreateAccess(c); !allowed {
-		c.JSON(http.StatusForbidden, common.NewError("auth", errors.New("permission denied")))
-		return
+// Writes to the missing key are creating it
+func KeyExistenceCheck(c *gin.Context) (bool, error) {
+	_, err := FindCachedKey(c.Param("name"))
+	if gorm.IsRecordNotFoundError(err) {
+		return false, nil
 	}
+	return err == nil, err
+}
+
+func KeyCreate(c *gin.Context) {
 	name := c.Param("name")
 	keyModelValidator := NewKeyModelValidator()
 	keyModelValidator.Name = name
@@ -43,7 +90,7 @@ func KeyCreate(c *gin.Context) {
 		return
 	}
 
-	if err := SaveOne(&keyModelValidator.keyModel); err != nil {
+	if err := SaveKeyModel(&keyModelValidator.keyModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -75,7 +122,7 @@ func KeyList(c *gin.Context) {
 
 func KeyRetrieve(c *gin.Context) {
 	name := c.Param("name")
-	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	keyModel, err := FindCachedKey(name)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
 		return
@@ -85,21 +132,29 @@ func KeyRetrieve(c *gin.Context) {
 }
 
 func KeyUpdate(c *gin.Context) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
 	name := c.Param("name")
 	keyModel, err := FindOneKey(&KeyModel{Name: name})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
 		return
 	}
-	keyModelValidator := NewKeyModelValidatorFillWith(keyModel)
-	if err := keyModelValidator.Bind(c); err != nil {
+	keyConfigValidator := NewKeyConfigValidatorFillWith(keyModel)
+	if err := keyConfigValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("keys", err))
 		return
 	}
 
-	keyModelValidator.keyModel.KeyID = keyModel.KeyID
-	if err := keyModel.Update(keyModelValidator.keyModel); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+	if len(keyConfigValidator.updates) > 0 {
+		if err := keyModel.Update(keyConfigValidator.updates); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	keyModel, err = FindOneKey(&KeyModel{Name: name})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("database", err))
 		return
 	}
 	serializer := KeySerializer{c, keyModel}
@@ -108,25 +163,35 @@ func KeyUpdate(c *gin.Context) {
 
 func KeyRotate(c *gin.Context) {
 	name := c.Param("name")
-	keyModel, err := FindOneKey(&KeyModel{Name: name})
-	if err != nil {
+	keyModel, err := rotateKey(name)
+	if gorm.IsRecordNotFoundError(err) {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
 		return
 	}
-	key, err := createNewAESKeyModel(keyModel.LatestVersion+1, AES_KEY_SIZE_256)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("keys", err))
 		return
 	}
-	keyModel.Keys = append(keyModel.Keys, key)
-	keyModelValidator := NewKeyModelValidatorFillWith(keyModel)
-	if err := keyModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewError("keys", err))
+	serializer := KeySerializer{c, keyModel}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func KeyTrim(c *gin.Context) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	name := c.Param("name")
+	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
+		return
+	}
+	keyTrimValidator := NewKeyTrimValidatorFillWith(keyModel)
+	if err := keyTrimValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("keys", err))
 		return
 	}
 
-	keyModelValidator.keyModel.KeyID = keyModel.KeyID
-	if err := keyModel.Update(keyModelValidator.keyModel); err != nil {
+	if err := keyModel.Trim(keyTrimValidator.minAvailableVersion); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -162,19 +227,44 @@ func EncryptData(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("encrypt", err))
 		return
 	}
-	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	keyModel, err := FindCachedKey(name)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
 		return
 	}
 
-	key, err := findKeyVersion(keyModel.Keys, keyModel.LatestVersion)
+	if !keyModel.SupportsEncryption {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support encryption", keyModel.Type)))
+		return
+	}
+
+	if encryptDataValidator.isBatch() {
+		items := encryptDataValidator.batchItems
+		processBatch(items, func(aesPayload *AESPayload) error {
+			return encryptPayload(keyModel, aesPayload)
+		})
+		status := http.StatusOK
+		if batchFailed(items) {
+			status = http.StatusBadRequest
+		}
+		serializer := EncryptBatchSerializer{C: c, Items: items}
+		c.JSON(status, common.NewGenericResponse(c, serializer.Response()))
+		return
+	}
+
+	version, err := getEncryptionVersion(keyModel, encryptDataValidator.aesPayload.KeyVersion)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	key, err := findKeyVersion(keyModel.Keys, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", keyModel.LatestVersion)))
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", version)))
 		return
 	}
 
-	if err := encryptDataWithAES(key, &encryptDataValidator.aesPayload); err != nil {
+	if err := encryptData(keyModel, key, &encryptDataValidator.aesPayload); err != nil {
 		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
 		return
 	}
@@ -183,6 +273,33 @@ func EncryptData(c *gin.Context) {
 	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
 }
 
+func DataKey(c *gin.Context) {
+	name := c.Param("name")
+	dataKeyValidator := NewDataKeyValidator()
+	if err := dataKeyValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("datakey", err))
+		return
+	}
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	if !keyModel.SupportsEncryption {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support encryption", keyModel.Type)))
+		return
+	}
+
+	if err := encryptPayload(keyModel, &dataKeyValidator.aesPayload); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	serializer := DataKeySerializer{C: c, AESPayload: dataKeyValidator.aesPayload, IncludePlaintext: dataKeyValidator.plaintext}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
 func DecryptData(c *gin.Context) {
 	name := c.Param("name")
 	decryptDataValidator := NewDecryptDataValidator()
@@ -190,12 +307,31 @@ func DecryptData(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("decrypt", err))
 		return
 	}
-	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	keyModel, err := FindCachedKey(name)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
 		return
 	}
 
+	if !keyModel.SupportsDecryption {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support decryption", keyModel.Type)))
+		return
+	}
+
+	if decryptDataValidator.isBatch() {
+		items := decryptDataValidator.batchItems
+		processBatch(items, func(aesPayload *AESPayload) error {
+			return decryptPayload(keyModel, aesPayload)
+		})
+		status := http.StatusOK
+		if batchFailed(items) {
+			status = http.StatusBadRequest
+		}
+		serializer := DecryptBatchSerializer{C: c, Items: items}
+		c.JSON(status, common.NewGenericResponse(c, serializer.Response()))
+		return
+	}
+
 	if decryptDataValidator.aesPayload.Version < keyModel.MinDecryptionVersion {
 		c.JSON(http.StatusForbidden, common.NewError("keys", fmt.Errorf("minimum version to decrypt is v%d, but you're requested v%d to be decrypted", keyModel.MinDecryptionVersion, decryptDataValidator.aesPayload.Version)))
 		return
@@ -207,7 +343,7 @@ func DecryptData(c *gin.Context) {
 		return
 	}
 
-	if err := decryptDataWithAES(key, &decryptDataValidator.aesPayload); err != nil {
+	if err := decryptData(keyModel, key, &decryptDataValidator.aesPayload); err != nil {
 		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
 		return
 	}
@@ -223,12 +359,31 @@ func RewrapData(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("decrypt", err))
 		return
 	}
-	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	keyModel, err := FindCachedKey(name)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
 		return
 	}
 
+	if !keyModel.SupportsDecryption {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support decryption", keyModel.Type)))
+		return
+	}
+
+	if decryptDataValidator.isBatch() {
+		items := decryptDataValidator.batchItems
+		processBatch(items, func(aesPayload *AESPayload) error {
+			return rewrapPayload(keyModel, aesPayload)
+		})
+		status := http.StatusOK
+		if batchFailed(items) {
+			status = http.StatusBadRequest
+		}
+		serializer := EncryptBatchSerializer{C: c, Items: items}
+		c.JSON(status, common.NewGenericResponse(c, serializer.Response()))
+		return
+	}
+
 	if decryptDataValidator.aesPayload.Version < keyModel.MinDecryptionVersion {
 		c.JSON(http.StatusForbidden, common.NewError("keys", fmt.Errorf("minimum version to decrypt is v%d, but you're requested v%d to be decrypted", keyModel.MinDecryptionVersion, decryptDataValidator.aesPayload.Version)))
 		return
@@ -240,7 +395,7 @@ func RewrapData(c *gin.Context) {
 		return
 	}
 
-	if err := decryptDataWithAES(key, &decryptDataValidator.aesPayload); err != nil {
+	if err := decryptData(keyModel, key, &decryptDataValidator.aesPayload); err != nil {
 		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
 		return
 	}
@@ -251,13 +406,19 @@ func RewrapData(c *gin.Context) {
 		return
 	}
 
-	keyLatest, err := findKeyVersion(keyModel.Keys, keyModel.LatestVersion)
+	version, err := getEncryptionVersion(keyModel, encryptDataValidator.aesPayload.KeyVersion)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	keyLatest, err := findKeyVersion(keyModel.Keys, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", keyModel.LatestVersion)))
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", version)))
 		return
 	}
 
-	if err := encryptDataWithAES(keyLatest, &encryptDataValidator.aesPayload); err != nil {
+	if err := encryptData(keyModel, keyLatest, &encryptDataValidator.aesPayload); err != nil {
 		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
 		return
 	}
@@ -265,3 +426,322 @@ func RewrapData(c *gin.Context) {
 	serializer := EncryptDataSerializer{C: c, AESPayload: encryptDataValidator.aesPayload}
 	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
 }
+
+func SignData(c *gin.Context) {
+	name := c.Param("name")
+	signDataValidator := NewSignDataValidator()
+	if err := signDataValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("sign", err))
+		return
+	}
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	if !keyModel.SupportsSigning {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support signing", keyModel.Type)))
+		return
+	}
+
+	version, err := getEncryptionVersion(keyModel, signDataValidator.signPayload.Version)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	key, err := findKeyVersion(keyModel.Keys, version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", version)))
+		return
+	}
+
+	if err := signData(keyModel.Type, key, &signDataValidator.signPayload); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	serializer := SignDataSerializer{C: c, SignPayload: signDataValidator.signPayload}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func VerifyData(c *gin.Context) {
+	name := c.Param("name")
+	verifyDataValidator := NewVerifyDataValidator()
+	if err := verifyDataValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("verify", err))
+		return
+	}
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	if !verifyDataValidator.isHMAC && !keyModel.SupportsSigning {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key type %s does not support verification", keyModel.Type)))
+		return
+	}
+
+	version := verifyDataValidator.signPayload.Version
+	if version < keyModel.MinDecryptionVersion {
+		c.JSON(http.StatusForbidden, common.NewError("keys", fmt.Errorf("minimum version to verify is v%d, but you're requested v%d to be verified", keyModel.MinDecryptionVersion, version)))
+		return
+	}
+
+	key, err := findKeyVersion(keyModel.Keys, version)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", version)))
+		return
+	}
+
+	if verifyDataValidator.isHMAC {
+		err = verifyHMAC(key, &verifyDataValidator.signPayload, verifyDataValidator.signature)
+	} else {
+		err = verifySignature(keyModel.Type, key, &verifyDataValidator.signPayload, verifyDataValidator.signature)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	serializer := VerifyDataSerializer{C: c, SignPayload: verifyDataValidator.signPayload}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func HMACData(c *gin.Context) {
+	name := c.Param("name")
+	hmacDataValidator := NewHMACDataValidator()
+	if err := hmacDataValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("hmac", err))
+		return
+	}
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	version, err := getEncryptionVersion(keyModel, hmacDataValidator.hmacPayload.Version)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	key, err := findKeyVersion(keyModel.Keys, version)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", version)))
+		return
+	}
+
+	if err := hmacData(key, &hmacDataValidator.hmacPayload); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	serializer := HMACDataSerializer{C: c, HMACPayload: hmacDataValidator.hmacPayload}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func HashData(c *gin.Context) {
+	hashDataValidator := NewHashDataValidator()
+	if err := hashDataValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("hash", err))
+		return
+	}
+
+	if err := hashData(&hashDataValidator.hashPayload); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	serializer := HashDataSerializer{C: c, HashPayload: hashDataValidator.hashPayload}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func ExportKey(c *gin.Context) {
+	name := c.Param("name")
+	exportType := c.Param("type")
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	if !keyModel.Exportable {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", errors.New("key is not exportable")))
+		return
+	}
+
+	if err := isExportSupported(keyModel.Type, exportType); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+
+	keys := keyModel.Keys
+	if version := c.Param("version"); version != "" {
+		requested := keyModel.LatestVersion
+		if version != "latest" {
+			requested, err = strconv.Atoi(version)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, common.NewError("transit", errors.New("version should be an integer or \"latest\"")))
+				return
+			}
+		}
+		key, err := findKeyVersion(keyModel.Keys, requested)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, common.NewError("transit", fmt.Errorf("key version v%d doesn't exist", requested)))
+			return
+		}
+		keys = []AESKeyModel{key}
+	}
+
+	serializer := ExportKeySerializer{C: c, Name: keyModel.Name, Type: keyModel.Type, Keys: make(map[int]string)}
+	for _, key := range keys {
+		exported, err := exportKey(keyModel.Type, exportType, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
+			return
+		}
+		serializer.Keys[key.Version] = exported
+	}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func BackupKey(c *gin.Context) {
+	name := c.Param("name")
+	keyModel, err := FindCachedKey(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("key not found")))
+		return
+	}
+
+	if !keyModel.Exportable {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", errors.New("key is not exportable")))
+		return
+	}
+	if !keyModel.AllowPlaintextBackup {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", errors.New("plaintext backup is not allowed for the key")))
+		return
+	}
+
+	backup, err := backupKey(keyModel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
+		return
+	}
+	serializer := BackupKeySerializer{C: c, Backup: backup}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func RestoreKey(c *gin.Context) {
+	keyRestoreValidator := NewKeyRestoreValidator()
+	if err := keyRestoreValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("transit", err))
+		return
+	}
+
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	restored := keyRestoreValidator.keyModel
+	existing, err := FindOneKey(&KeyModel{Name: restored.Name})
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusInternalServerError, common.NewError("database", err))
+		return
+	}
+	if err == nil && !keyRestoreValidator.force {
+		c.JSON(http.StatusConflict, common.NewError("transit", errors.New("key already exists, use force to overwrite it")))
+		return
+	}
+
+	if err := RestoreKeyModel(&existing, &restored); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := KeySerializer{c, restored}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func WrappingKey(c *gin.Context) {
+	publicKey, err := getWrappingPublicKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("transit", err))
+		return
+	}
+	serializer := WrappingKeySerializer{C: c, PublicKey: publicKey}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+// Size of the key cache in the same format as Vault, 0 means the cache is unlimited
+func KeyCacheConfigRetrieve(c *gin.Context) {
+	serializer := KeyCacheConfigSerializer{C: c, Size: GetKeyCacheStats().Size}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func KeyCacheConfigUpdate(c *gin.Context) {
+	keyCacheConfigValidator := NewKeyCacheConfigValidator()
+	if err := keyCacheConfigValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("transit", err))
+		return
+	}
+	if err := SetKeyCacheSize(keyCacheConfigValidator.size); err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("database", err))
+		return
+	}
+	serializer := KeyCacheConfigSerializer{C: c, Size: keyCacheConfigValidator.size}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+// Metrics of the key cache, served separately from the Vault compatible cache-config
+func KeyCacheStatsRetrieve(c *gin.Context) {
+	serializer := KeyCacheStatsSerializer{C: c, KeyCacheStats: GetKeyCacheStats()}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func KeyImport(c *gin.Context) {
+	name := c.Param("name")
+	keyImportValidator := NewKeyImportValidator()
+	keyImportValidator.Name = name
+	if err := keyImportValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("keys", err))
+		return
+	}
+
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	if keyModel, err := FindOneKey(&KeyModel{Name: name}); err == nil || keyModel.ID != 0 {
+		c.JSON(http.StatusConflict, common.NewError("keys", errors.New("key already exist")))
+		return
+	}
+
+	if err := SaveKeyModel(&keyImportValidator.keyModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := KeySerializer{c, keyImportValidator.keyModel}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
+
+func KeyImportVersion(c *gin.Context) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	name := c.Param("name")
+	keyModel, err := FindOneKey(&KeyModel{Name: name})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("keys", errors.New("Key not found")))
+		return
+	}
+	keyImportVersionValidator := NewKeyImportVersionValidatorFillWith(keyModel)
+	if err := keyImportVersionValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("keys", err))
+		return
+	}
+
+	if err := SaveKeyModel(&keyImportVersionValidator.keyModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := KeySerializer{c, keyImportVersionValidator.keyModel}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
@@ -0,0 +1,810 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miknikif/vault-auto-unseal/barrier"
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/stretchr/testify/require"
+)
+
+var testRouter *gin.Engine
+
+// Server is set up with the fresh DB and the static master key, so the barrier is unsealed right away
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "vau-keys")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_DB_PATH), dir)
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_LOG_LEVEL), "error")
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_MASTER_KEY), base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, barrier.MASTER_KEY_SIZE)))
+
+	conf, err := common.GetConfig()
+	if err != nil {
+		panic(err)
+	}
+	conf.DB.AutoMigrate(&AESKeyModel{}, &KeyModel{}, &WrappingKeyModel{}, &KeyCacheConfigModel{}, &barrier.BarrierModel{})
+	if err := barrier.Setup(conf); err != nil {
+		panic(err)
+	}
+	if _, err := barrier.Initialize(0, 0, nil); err != nil {
+		panic(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	testRouter = gin.New()
+	testRouter.Use(common.JSONMiddleware(false))
+	testRouter.Use(common.RequestIDMiddleware())
+	testRouter.Use(func(c *gin.Context) {
+		c.Set(common.IS_ROOT, true)
+	})
+	KeysOperationsRegister(testRouter.Group("/v1/transit"))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type testKeyResponse struct {
+	Data   KeyResponse `json:"data"`
+	Errors []string    `json:"errors"`
+}
+
+func serveRequest(method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+func performRequest(t *testing.T, method string, path string, body string) (int, testKeyResponse) {
+	var res testKeyResponse
+	w := serveRequest(method, path, body)
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	}
+	return w.Code, res
+}
+
+// Decode the data of the response into the provided value
+func performDataRequest(t *testing.T, method string, path string, body string, data interface{}) (int, []string) {
+	res := struct {
+		Data   interface{} `json:"data"`
+		Errors []string    `json:"errors"`
+	}{Data: data}
+	w := serveRequest(method, path, body)
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	}
+	return w.Code, res.Errors
+}
+
+func createTestKey(t *testing.T, name string, body string) KeyResponse {
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/"+name, body)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	return res.Data
+}
+
+func rotateTestKey(t *testing.T, name string) {
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/"+name+"/rotate", "{}")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+}
+
+func TestKeyUpdate_NotFound(t *testing.T) {
+	code, _ := performRequest(t, http.MethodPut, "/v1/transit/keys/missing/config", `{"deletion_allowed":"true"}`)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestKeyUpdate_PartialUpdate(t *testing.T) {
+	createTestKey(t, "partial", `{"auto_rotate_period":"24h","exportable":"true"}`)
+	rotateTestKey(t, "partial")
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/partial/config", `{"deletion_allowed":"true"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.True(t, res.Data.DeletionAllowed)
+	require.True(t, res.Data.Exportable)
+	require.Equal(t, 24*60*60, res.Data.AutoRotatePeriod)
+	require.Equal(t, 2, res.Data.LatestVersion)
+	require.Len(t, res.Data.Keys, 2)
+
+	code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/partial/config", `{"min_decryption_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, 2, res.Data.MinDecryptionVersion)
+	require.Equal(t, 1, res.Data.MinEncryptionVersion)
+	require.True(t, res.Data.DeletionAllowed)
+}
+
+func TestKeyUpdate_EmptyBody(t *testing.T) {
+	created := createTestKey(t, "empty", `{"deletion_allowed":"true"}`)
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/empty/config", "")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, created, res.Data)
+}
+
+func TestKeyUpdate_ReturnsUpdatedKey(t *testing.T) {
+	createTestKey(t, "updated", "{}")
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/updated/config", `{"auto_rotate_period":"2h","allow_plaintext_backup":"true"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, 2*60*60, res.Data.AutoRotatePeriod)
+	require.True(t, res.Data.AllowPlaintextBackup)
+
+	code, res = performRequest(t, http.MethodGet, "/v1/transit/keys/updated", "")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, 2*60*60, res.Data.AutoRotatePeriod)
+	require.True(t, res.Data.AllowPlaintextBackup)
+}
+
+// False and 0 values should be saved the same way as any other value
+func TestKeyUpdate_ZeroValues(t *testing.T) {
+	createTestKey(t, "zero", `{"deletion_allowed":"true","auto_rotate_period":"1h"}`)
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/zero/config", `{"deletion_allowed":"false","auto_rotate_period":"0"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.False(t, res.Data.DeletionAllowed)
+	require.Equal(t, 0, res.Data.AutoRotatePeriod)
+
+	code, res = performRequest(t, http.MethodGet, "/v1/transit/keys/zero", "")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.False(t, res.Data.DeletionAllowed)
+	require.Equal(t, 0, res.Data.AutoRotatePeriod)
+}
+
+func TestKeyUpdate_JSONTypes(t *testing.T) {
+	createTestKey(t, "json", "{}")
+	rotateTestKey(t, "json")
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/json/config", `{"deletion_allowed":true,"min_decryption_version":2,"min_encryption_version":2,"auto_rotate_period":7200}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.True(t, res.Data.DeletionAllowed)
+	require.Equal(t, 2, res.Data.MinDecryptionVersion)
+	require.Equal(t, 2, res.Data.MinEncryptionVersion)
+	require.Equal(t, 2*60*60, res.Data.AutoRotatePeriod)
+}
+
+func TestKeyUpdate_Latches(t *testing.T) {
+	createTestKey(t, "latch", `{"exportable":"true","allow_plaintext_backup":true}`)
+
+	for _, body := range []string{`{"exportable":"false"}`, `{"allow_plaintext_backup":false}`} {
+		code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/latch/config", body)
+		require.Equal(t, http.StatusUnprocessableEntity, code, body)
+		require.NotEmpty(t, res.Errors)
+	}
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/latch/config", `{"exportable":"true","deletion_allowed":"true"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.True(t, res.Data.Exportable)
+	require.True(t, res.Data.AllowPlaintextBackup)
+	require.True(t, res.Data.DeletionAllowed)
+
+	code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/latch/config", `{"deletion_allowed":"false"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.False(t, res.Data.DeletionAllowed)
+}
+
+func TestKeyUpdate_Validation(t *testing.T) {
+	createTestKey(t, "invalid", "{}")
+	rotateTestKey(t, "invalid")
+	rotateTestKey(t, "invalid")
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid bool", body: `{"deletion_allowed":"maybe"}`},
+		{name: "invalid version", body: `{"min_decryption_version":"two"}`},
+		{name: "version above latest", body: `{"min_decryption_version":"4"}`},
+		{name: "version below min available", body: `{"min_encryption_version":"0"}`},
+		{name: "encryption version below decryption version", body: `{"min_decryption_version":"3","min_encryption_version":"2"}`},
+		{name: "short rotation period", body: `{"auto_rotate_period":"10m"}`},
+		{name: "invalid rotation period", body: `{"auto_rotate_period":"often"}`},
+		{name: "object value", body: `{"exportable":{"value":true}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/invalid/config", tt.body)
+			require.Equal(t, http.StatusUnprocessableEntity, code)
+			require.NotEmpty(t, res.Errors)
+		})
+	}
+
+	// Failed updates shouldn't change anything
+	code, res := performRequest(t, http.MethodGet, "/v1/transit/keys/invalid", "")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.False(t, res.Data.DeletionAllowed)
+	require.False(t, res.Data.Exportable)
+	require.Equal(t, 1, res.Data.MinDecryptionVersion)
+	require.Equal(t, 1, res.Data.MinEncryptionVersion)
+	require.Equal(t, 0, res.Data.AutoRotatePeriod)
+}
+
+// Min encryption version is checked against the saved min decryption version as well
+func TestKeyUpdate_MinVersions(t *testing.T) {
+	createTestKey(t, "versions", "{}")
+	rotateTestKey(t, "versions")
+	rotateTestKey(t, "versions")
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/versions/config", `{"min_decryption_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/versions/config", `{"min_encryption_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+
+	code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/versions/config", `{"min_decryption_version":"3"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.NotEmpty(t, res.Errors)
+
+	code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/versions/config", `{"min_decryption_version":"3","min_encryption_version":"3"}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.Equal(t, 3, res.Data.MinDecryptionVersion)
+	require.Equal(t, 3, res.Data.MinEncryptionVersion)
+}
+
+// Writes to the missing key are creates, everything else is an update
+func TestKeyExistenceCheck(t *testing.T) {
+	createTestKey(t, "existing", "{}")
+
+	var exists bool
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		var err error
+		exists, err = common.CheckExistence(c)
+		require.NoError(t, err)
+		c.AbortWithStatus(http.StatusNoContent)
+	})
+	KeysRegister(router.Group("/v1/transit/keys"))
+
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{path: "/v1/transit/keys/missing", exists: false},
+		{path: "/v1/transit/keys/existing", exists: true},
+		{path: "/v1/transit/keys/missing/import", exists: false},
+		{path: "/v1/transit/keys/existing/import", exists: true},
+		{path: "/v1/transit/keys/missing/rotate", exists: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, tt.path, bytes.NewBufferString("{}"))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusNoContent, w.Code)
+			require.Equal(t, tt.exists, exists)
+		})
+	}
+}
+
+// Every key type which supports encryption goes through the whole lifecycle of the ciphertext
+func TestKeyTypes_RoundTrip(t *testing.T) {
+	plaintext := base64.StdEncoding.EncodeToString([]byte("unseal"))
+	createTestKey(t, "type-other", "{}")
+	rotateTestKey(t, "type-other")
+	for _, keyType := range []KeyType{KEY_TYPE_AES128_GCM96, KEY_TYPE_AES256_GCM96, KEY_TYPE_CHACHA20_POLY1305, KEY_TYPE_RSA_2048, KEY_TYPE_RSA_3072, KEY_TYPE_RSA_4096} {
+		t.Run(string(keyType), func(t *testing.T) {
+			name := "type-" + string(keyType)
+			created := createTestKey(t, name, fmt.Sprintf(`{"type":%q}`, keyType))
+			require.Equal(t, keyType, created.Type)
+			require.True(t, created.SupportsEncryption)
+			require.True(t, created.SupportsDecryption)
+			require.Equal(t, !keyType.IsRSA(), created.SupportsDerivation)
+			require.Equal(t, keyType.IsRSA(), created.SupportsSigning)
+
+			var encrypted EncryptDataResponse
+			code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":%q}`, plaintext), &encrypted)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, strings.HasPrefix(encrypted.Ciphertext, "vault:v1:"), encrypted.Ciphertext)
+
+			rotateTestKey(t, name)
+			var decrypted DecryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/"+name, fmt.Sprintf(`{"ciphertext":%q}`, encrypted.Ciphertext), &decrypted)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.Equal(t, plaintext, decrypted.Plaintext)
+
+			var rewrapped EncryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/rewrap/"+name, fmt.Sprintf(`{"ciphertext":%q}`, encrypted.Ciphertext), &rewrapped)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, strings.HasPrefix(rewrapped.Ciphertext, "vault:v2:"), rewrapped.Ciphertext)
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/"+name, fmt.Sprintf(`{"ciphertext":%q}`, rewrapped.Ciphertext), &decrypted)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.Equal(t, plaintext, decrypted.Plaintext)
+
+			// Ciphertext can't be decrypted by the other key
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/type-other", fmt.Sprintf(`{"ciphertext":%q}`, rewrapped.Ciphertext), nil)
+			require.NotEqual(t, http.StatusOK, code)
+			require.NotEmpty(t, errs)
+		})
+	}
+}
+
+// RSA keys don't support the key derivation, so the derived and convergent keys can't be created
+func TestKeyTypes_RSADerivation(t *testing.T) {
+	for _, body := range []string{`{"type":"rsa-2048","derived":"true"}`, `{"type":"rsa-2048","derived":"true","convergent_encryption":"true"}`, `{"type":"rsa-2048","convergent_encryption":"true"}`} {
+		code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/rsa-derived", body)
+		require.Equal(t, http.StatusUnprocessableEntity, code, body)
+		require.NotEmpty(t, res.Errors, body)
+	}
+	code, _ := performRequest(t, http.MethodGet, "/v1/transit/keys/rsa-derived", "")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestSignVerify(t *testing.T) {
+	input := base64.StdEncoding.EncodeToString([]byte("unseal"))
+	for _, keyType := range []KeyType{KEY_TYPE_ED25519, KEY_TYPE_ECDSA_P256} {
+		t.Run(string(keyType), func(t *testing.T) {
+			name := "sign-" + string(keyType)
+			createTestKey(t, name, fmt.Sprintf(`{"type":%q}`, keyType))
+
+			var signed SignDataResponse
+			code, errs := performDataRequest(t, http.MethodPost, "/v1/transit/sign/"+name, fmt.Sprintf(`{"input":%q}`, input), &signed)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, strings.HasPrefix(signed.Signature, "vault:v1:"), signed.Signature)
+			require.Equal(t, 1, signed.KeyVersion)
+
+			var verified VerifyDataResponse
+			code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/verify/"+name, fmt.Sprintf(`{"input":%q,"signature":%q}`, input, signed.Signature), &verified)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, verified.Valid)
+
+			// Signature with the flipped byte and the signature of the other input shouldn't be valid
+			sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(signed.Signature, "vault:v1:"))
+			require.NoError(t, err)
+			sig[len(sig)/2] ^= 0xff
+			tampered := "vault:v1:" + base64.StdEncoding.EncodeToString(sig)
+			code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/verify/"+name, fmt.Sprintf(`{"input":%q,"signature":%q}`, input, tampered), &verified)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.False(t, verified.Valid)
+
+			other := base64.StdEncoding.EncodeToString([]byte("seal"))
+			code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/verify/"+name, fmt.Sprintf(`{"input":%q,"signature":%q}`, other, signed.Signature), &verified)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.False(t, verified.Valid)
+		})
+	}
+
+	createTestKey(t, "sign-aes", "{}")
+	code, errs := performDataRequest(t, http.MethodPost, "/v1/transit/sign/sign-aes", fmt.Sprintf(`{"input":%q}`, input), nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.NotEmpty(t, errs)
+}
+
+func TestHashData(t *testing.T) {
+	input := []byte("unseal")
+	sha256Sum := sha256.Sum256(input)
+	sha384Sum := sha512.Sum384(input)
+	sha512Sum := sha512.Sum512(input)
+	tests := []struct {
+		path      string
+		algorithm string
+		format    string
+		sum       string
+	}{
+		{path: "/v1/transit/hash", sum: hex.EncodeToString(sha256Sum[:])},
+		{path: "/v1/transit/hash/sha2-256", format: "hex", sum: hex.EncodeToString(sha256Sum[:])},
+		{path: "/v1/transit/hash/sha2-384", sum: hex.EncodeToString(sha384Sum[:])},
+		{path: "/v1/transit/hash", algorithm: "sha2-512", format: "base64", sum: base64.StdEncoding.EncodeToString(sha512Sum[:])},
+		{path: "/v1/transit/hash/sha2-512", algorithm: "sha2-256", format: "base64", sum: base64.StdEncoding.EncodeToString(sha512Sum[:])},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s %s", tt.path, tt.algorithm, tt.format), func(t *testing.T) {
+			var res HashDataResponse
+			body := fmt.Sprintf(`{"input":%q,"algorithm":%q,"format":%q}`, base64.StdEncoding.EncodeToString(input), tt.algorithm, tt.format)
+			code, errs := performDataRequest(t, http.MethodPost, tt.path, body, &res)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.Equal(t, tt.sum, res.Sum)
+		})
+	}
+
+	for _, body := range []string{`{"input":"dGVzdA==","algorithm":"md5"}`, `{"input":"dGVzdA==","format":"binary"}`, `{"input":"not b64!"}`, `{}`} {
+		code, errs := performDataRequest(t, http.MethodPost, "/v1/transit/hash", body, nil)
+		require.NotEqual(t, http.StatusOK, code, body)
+		require.NotEmpty(t, errs, body)
+	}
+}
+
+func TestHMACData(t *testing.T) {
+	createTestKey(t, "hmac", "{}")
+	input := base64.StdEncoding.EncodeToString([]byte("unseal"))
+	hmacOf := func(path string, body string) HMACDataResponse {
+		var res HMACDataResponse
+		code, errs := performDataRequest(t, http.MethodPost, path, body, &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		return res
+	}
+	verify := func(path string, mac string) bool {
+		var res VerifyDataResponse
+		code, errs := performDataRequest(t, http.MethodPost, path, fmt.Sprintf(`{"input":%q,"hmac":%q}`, input, mac), &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		return res.Valid
+	}
+
+	sizes := map[string]int{"sha2-256": 32, "sha2-384": 48, "sha2-512": 64}
+	for algorithm, size := range sizes {
+		mac := hmacOf("/v1/transit/hmac/hmac/"+algorithm, fmt.Sprintf(`{"input":%q}`, input)).HMAC
+		require.True(t, strings.HasPrefix(mac, "vault:v1:"), mac)
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(mac, "vault:v1:"))
+		require.NoError(t, err)
+		require.Len(t, decoded, size, algorithm)
+		require.Equal(t, mac, hmacOf("/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q,"algorithm":%q}`, input, algorithm)).HMAC)
+		require.True(t, verify("/v1/transit/verify/hmac/"+algorithm, mac), algorithm)
+		if algorithm != DEFAULT_HASH_ALGORITHM {
+			require.False(t, verify("/v1/transit/verify/hmac", mac), "hmac verified with the default algorithm")
+		}
+	}
+
+	v1 := hmacOf("/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q}`, input)).HMAC
+	rotateTestKey(t, "hmac")
+	v2 := hmacOf("/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q}`, input)).HMAC
+	require.True(t, strings.HasPrefix(v2, "vault:v2:"), v2)
+	require.Equal(t, v1, hmacOf("/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q,"key_version":1}`, input)).HMAC)
+	require.Equal(t, v1, hmacOf("/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q,"key_version":"1"}`, input)).HMAC)
+	require.True(t, verify("/v1/transit/verify/hmac", v1))
+	require.True(t, verify("/v1/transit/verify/hmac", v2))
+
+	// HMAC is verified with the key version from its prefix
+	require.False(t, verify("/v1/transit/verify/hmac", "vault:v2:"+strings.TrimPrefix(v1, "vault:v1:")))
+	require.False(t, verify("/v1/transit/verify/hmac", "vault:v1:"+strings.TrimPrefix(v2, "vault:v2:")))
+	code, errs := performDataRequest(t, http.MethodPost, "/v1/transit/verify/hmac", fmt.Sprintf(`{"input":%q,"hmac":%q}`, input, "vault:v3:"+strings.TrimPrefix(v2, "vault:v2:")), nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.NotEmpty(t, errs)
+	code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/hmac/hmac", fmt.Sprintf(`{"input":%q,"key_version":3}`, input), nil)
+	require.NotEqual(t, http.StatusOK, code)
+	require.NotEmpty(t, errs)
+
+	for _, path := range []string{"/v1/transit/hmac/hmac/md5", "/v1/transit/hmac/hmac/sha2-1024"} {
+		code, errs = performDataRequest(t, http.MethodPost, path, fmt.Sprintf(`{"input":%q}`, input), nil)
+		require.Equal(t, http.StatusUnprocessableEntity, code, path)
+		require.NotEmpty(t, errs, path)
+	}
+	code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/verify/hmac/md5", fmt.Sprintf(`{"input":%q,"hmac":%q}`, input, v2), nil)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.NotEmpty(t, errs)
+}
+
+func TestEncryptData_DerivedConvergent(t *testing.T) {
+	createTestKey(t, "convergent", `{"derived":"true","convergent_encryption":"true"}`)
+	createTestKey(t, "derived", `{"derived":"true"}`)
+	context := base64.StdEncoding.EncodeToString([]byte("host-1"))
+	encrypt := func(name string, context string) string {
+		var res EncryptDataResponse
+		code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":"dGVzdA==","context":%q}`, context), &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		return res.Ciphertext
+	}
+
+	ct := encrypt("convergent", context)
+	require.Equal(t, ct, encrypt("convergent", context))
+	require.NotEqual(t, ct, encrypt("convergent", base64.StdEncoding.EncodeToString([]byte("host-2"))))
+	require.NotEqual(t, encrypt("derived", context), encrypt("derived", context))
+
+	var res DecryptDataResponse
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/convergent", fmt.Sprintf(`{"ciphertext":%q,"context":%q}`, ct, context), &res)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Equal(t, "dGVzdA==", res.Plaintext)
+
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/convergent", fmt.Sprintf(`{"ciphertext":%q,"context":"aG9zdC0y"}`, ct), nil)
+	require.NotEqual(t, http.StatusOK, code)
+	require.NotEmpty(t, errs)
+
+	// Context is required for every operation with the derived keys
+	for _, name := range []string{"convergent", "derived"} {
+		code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, `{"plaintext":"dGVzdA=="}`, nil)
+		require.NotEqual(t, http.StatusOK, code, name)
+		require.NotEmpty(t, errs, name)
+	}
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/convergent", fmt.Sprintf(`{"ciphertext":%q}`, ct), nil)
+	require.NotEqual(t, http.StatusOK, code)
+	require.NotEmpty(t, errs)
+}
+
+func TestBatchInput(t *testing.T) {
+	createTestKey(t, "batch", "{}")
+
+	var encrypted EncryptBatchResponse
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/batch", `{"batch_input":[
+		{"plaintext":"dGVzdA==","reference":"first"},
+		{"plaintext":"not b64!","reference":"second"},
+		{"plaintext":"dGVzdDI=","reference":"third"}
+	]}`, &encrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Len(t, encrypted.BatchResults, 3)
+	for i, reference := range []string{"first", "second", "third"} {
+		require.Equal(t, reference, encrypted.BatchResults[i].Reference)
+	}
+	require.Empty(t, encrypted.BatchResults[0].Error)
+	require.NotEmpty(t, encrypted.BatchResults[0].Ciphertext)
+	require.NotEmpty(t, encrypted.BatchResults[1].Error)
+	require.Empty(t, encrypted.BatchResults[1].Ciphertext)
+	require.Empty(t, encrypted.BatchResults[2].Error)
+
+	var decrypted DecryptBatchResponse
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/batch", fmt.Sprintf(`{"batch_input":[
+		{"ciphertext":%q},
+		{"ciphertext":"vault:v1:AAAA"},
+		{"ciphertext":%q}
+	]}`, encrypted.BatchResults[0].Ciphertext, encrypted.BatchResults[2].Ciphertext), &decrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Len(t, decrypted.BatchResults, 3)
+	require.Equal(t, "dGVzdA==", decrypted.BatchResults[0].Plaintext)
+	require.NotEmpty(t, decrypted.BatchResults[1].Error)
+	require.Equal(t, "dGVzdDI=", decrypted.BatchResults[2].Plaintext)
+
+	rotateTestKey(t, "batch")
+	var rewrapped EncryptBatchResponse
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/rewrap/batch", fmt.Sprintf(`{"batch_input":[
+		{"ciphertext":%q},
+		{"ciphertext":"garbage"}
+	]}`, encrypted.BatchResults[0].Ciphertext), &rewrapped)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Len(t, rewrapped.BatchResults, 2)
+	require.Equal(t, 2, rewrapped.BatchResults[0].KeyVersion)
+	require.True(t, strings.HasPrefix(rewrapped.BatchResults[0].Ciphertext, "vault:v2:"))
+	require.NotEmpty(t, rewrapped.BatchResults[1].Error)
+
+	// Batch fails only if every item fails
+	code, _ = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/batch", `{"batch_input":[{"ciphertext":"garbage"},{"ciphertext":"vault:v1:AAAA"}]}`, &decrypted)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Len(t, decrypted.BatchResults, 2)
+	for _, result := range decrypted.BatchResults {
+		require.NotEmpty(t, result.Error)
+	}
+}
+
+// key_version is accepted as a number or a string and has to be within the min encryption and the latest versions
+func TestEncryptData_KeyVersion(t *testing.T) {
+	createTestKey(t, "versioned", "{}")
+	rotateTestKey(t, "versioned")
+	rotateTestKey(t, "versioned")
+	code, key := performRequest(t, http.MethodPut, "/v1/transit/keys/versioned/config", `{"min_decryption_version":2,"min_encryption_version":2}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+
+	var encrypted EncryptDataResponse
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"plaintext":"dGVzdA==","key_version":2}`, &encrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Equal(t, 2, encrypted.Version)
+	require.True(t, strings.HasPrefix(encrypted.Ciphertext, "vault:v2:"))
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"plaintext":"dGVzdA==","key_version":"3"}`, &encrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Equal(t, 3, encrypted.Version)
+
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"plaintext":"dGVzdA==","key_version":1}`, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0], "requested key version v1 is lower than the min encryption version v2")
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"plaintext":"dGVzdA==","key_version":4}`, nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0], "requested key version v4 is higher than the latest version v3")
+	code, _ = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"plaintext":"dGVzdA==","key_version":"latest"}`, nil)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// Every batch item is checked against its own key_version
+	var batch EncryptBatchResponse
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/versioned", `{"batch_input":[
+		{"plaintext":"dGVzdA==","key_version":2},
+		{"plaintext":"dGVzdA==","key_version":1},
+		{"plaintext":"dGVzdA==","key_version":4},
+		{"plaintext":"dGVzdA=="}
+	]}`, &batch)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.Len(t, batch.BatchResults, 4)
+	require.Empty(t, batch.BatchResults[0].Error)
+	require.Equal(t, 2, batch.BatchResults[0].KeyVersion)
+	require.Contains(t, batch.BatchResults[1].Error, "lower than the min encryption version v2")
+	require.Contains(t, batch.BatchResults[2].Error, "higher than the latest version v3")
+	require.Empty(t, batch.BatchResults[3].Error)
+	require.Equal(t, 3, batch.BatchResults[3].KeyVersion)
+
+	// Rewrap encrypts with the requested version
+	var rewrapped EncryptDataResponse
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/rewrap/versioned", fmt.Sprintf(`{"ciphertext":%q,"key_version":2}`, encrypted.Ciphertext), &rewrapped)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.True(t, strings.HasPrefix(rewrapped.Ciphertext, "vault:v2:"))
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/rewrap/versioned", fmt.Sprintf(`{"ciphertext":%q,"key_version":1}`, encrypted.Ciphertext), nil)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, errs[0], "lower than the min encryption version v2")
+}
+
+// Data key is returned encrypted with the transit key, and in plaintext only for the plaintext type
+func TestDataKey(t *testing.T) {
+	createTestKey(t, "datakey", "{}")
+	for _, tc := range []struct {
+		body string
+		size int
+	}{
+		{body: "", size: 32},
+		{body: `{"bits":128}`, size: 16},
+		{body: `{"bits":"256"}`, size: 32},
+		{body: `{"bits":512}`, size: 64},
+	} {
+		for _, dataKeyType := range []string{"plaintext", "wrapped"} {
+			var dataKey DataKeyResponse
+			code, errs := performDataRequest(t, http.MethodPost, "/v1/transit/datakey/"+dataKeyType+"/datakey", tc.body, &dataKey)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, strings.HasPrefix(dataKey.Ciphertext, "vault:v1:"), dataKey.Ciphertext)
+			require.Equal(t, 1, dataKey.KeyVersion)
+
+			var decrypted DecryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/datakey", fmt.Sprintf(`{"ciphertext":%q}`, dataKey.Ciphertext), &decrypted)
+			require.Equal(t, http.StatusOK, code, errs)
+			key, err := base64.StdEncoding.DecodeString(decrypted.Plaintext)
+			require.NoError(t, err)
+			require.Len(t, key, tc.size, tc.body)
+			if dataKeyType == "plaintext" {
+				require.Equal(t, decrypted.Plaintext, dataKey.Plaintext)
+			} else {
+				require.Empty(t, dataKey.Plaintext)
+			}
+		}
+	}
+
+	for _, r := range []struct {
+		path string
+		body string
+	}{
+		{path: "/v1/transit/datakey/plaintext/datakey", body: `{"bits":64}`},
+		{path: "/v1/transit/datakey/wrapped/datakey", body: `{"bits":"many"}`},
+		{path: "/v1/transit/datakey/raw/datakey", body: "{}"},
+	} {
+		code, errs := performDataRequest(t, http.MethodPost, r.path, r.body, nil)
+		require.Equal(t, http.StatusUnprocessableEntity, code, r.body)
+		require.NotEmpty(t, errs, r.body)
+	}
+}
+
+func exportTestKey(t *testing.T, path string) ExportKeyResponse {
+	var res ExportKeyResponse
+	code, errs := performDataRequest(t, http.MethodGet, "/v1/transit/export/"+path, "", &res)
+	require.Equal(t, http.StatusOK, code, errs)
+	return res
+}
+
+// Exported key material should be usable outside of the transit, so it's checked against the transit results
+func TestExportKey(t *testing.T) {
+	createTestKey(t, "export-aes", `{"exportable":true}`)
+	plaintext := base64.StdEncoding.EncodeToString([]byte("unseal"))
+	var encrypted EncryptDataResponse
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/export-aes", fmt.Sprintf(`{"plaintext":%q}`, plaintext), &encrypted)
+	require.Equal(t, http.StatusOK, code, errs)
+	rotateTestKey(t, "export-aes")
+
+	exported := exportTestKey(t, "encryption-key/export-aes")
+	require.Equal(t, "export-aes", exported.Name)
+	require.Equal(t, KEY_TYPE_AES256_GCM96, exported.Type)
+	require.Len(t, exported.Keys, 2)
+	require.NotEqual(t, exported.Keys[1], exported.Keys[2])
+	require.Equal(t, map[int]string{1: exported.Keys[1]}, exportTestKey(t, "encryption-key/export-aes/1").Keys)
+	require.Equal(t, map[int]string{2: exported.Keys[2]}, exportTestKey(t, "encryption-key/export-aes/latest").Keys)
+
+	key, err := base64.StdEncoding.DecodeString(exported.Keys[1])
+	require.NoError(t, err)
+	require.Len(t, key, 32)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted.Ciphertext, "vault:v1:"))
+	require.NoError(t, err)
+	pt, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], nil)
+	require.NoError(t, err)
+	require.Equal(t, "unseal", string(pt))
+
+	var mac HMACDataResponse
+	code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/hmac/export-aes", fmt.Sprintf(`{"input":%q}`, plaintext), &mac)
+	require.Equal(t, http.StatusOK, code, errs)
+	hmacKey, err := base64.StdEncoding.DecodeString(exportTestKey(t, "hmac-key/export-aes/latest").Keys[2])
+	require.NoError(t, err)
+	expected := hmac.New(sha256.New, hmacKey)
+	expected.Write([]byte("unseal"))
+	require.Equal(t, "vault:v2:"+base64.StdEncoding.EncodeToString(expected.Sum(nil)), mac.HMAC)
+
+	createTestKey(t, "export-ed25519", `{"type":"ed25519","exportable":"true"}`)
+	signingKey, err := base64.StdEncoding.DecodeString(exportTestKey(t, "signing-key/export-ed25519/1").Keys[1])
+	require.NoError(t, err)
+	require.Len(t, signingKey, ed25519.PrivateKeySize)
+	signature := ed25519.Sign(ed25519.PrivateKey(signingKey), []byte("unseal"))
+	var verified VerifyDataResponse
+	code, errs = performDataRequest(t, http.MethodPost, "/v1/transit/verify/export-ed25519", fmt.Sprintf(`{"input":%q,"signature":%q}`, plaintext, "vault:v1:"+base64.StdEncoding.EncodeToString(signature)), &verified)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.True(t, verified.Valid)
+
+	invalid := []string{
+		"signing-key/export-aes",
+		"encryption-key/export-ed25519",
+		"public-key/export-aes",
+		"encryption-key/export-aes/3",
+		"encryption-key/export-aes/first",
+	}
+	for _, path := range invalid {
+		code, errs = performDataRequest(t, http.MethodGet, "/v1/transit/export/"+path, "", nil)
+		require.Equal(t, http.StatusBadRequest, code, path)
+		require.NotEmpty(t, errs, path)
+	}
+	code, _ = performDataRequest(t, http.MethodGet, "/v1/transit/export/encryption-key/export-missing", "", nil)
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+// Key is exported only after it's marked as exportable, and it can't be made non-exportable again
+func TestExportKey_Exportable(t *testing.T) {
+	createTestKey(t, "export-latch", "{}")
+	for _, exportType := range []string{"encryption-key", "hmac-key"} {
+		code, errs := performDataRequest(t, http.MethodGet, "/v1/transit/export/"+exportType+"/export-latch", "", nil)
+		require.Equal(t, http.StatusBadRequest, code, exportType)
+		require.Contains(t, errs[0], "key is not exportable")
+	}
+
+	code, res := performRequest(t, http.MethodPut, "/v1/transit/keys/export-latch/config", `{"exportable":true}`)
+	require.Equal(t, http.StatusOK, code, res.Errors)
+	require.True(t, res.Data.Exportable)
+	require.Len(t, exportTestKey(t, "encryption-key/export-latch").Keys, 1)
+
+	for _, body := range []string{`{"exportable":false}`, `{"exportable":"false"}`} {
+		code, res = performRequest(t, http.MethodPut, "/v1/transit/keys/export-latch/config", body)
+		require.Equal(t, http.StatusUnprocessableEntity, code, body)
+		require.NotEmpty(t, res.Errors, body)
+	}
+	require.Len(t, exportTestKey(t, "encryption-key/export-latch").Keys, 1)
+}
+
+// Trimmed versions are removed from the DB, so they can't be used for decryption anymore
+func TestKeyTrim_RemovesVersions(t *testing.T) {
+	createTestKey(t, "trimmed", "{}")
+	encrypt := func() EncryptDataResponse {
+		var res EncryptDataResponse
+		code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/trimmed", `{"plaintext":"dGVzdA=="}`, &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		return res
+	}
+	v1 := encrypt()
+	rotateTestKey(t, "trimmed")
+	rotateTestKey(t, "trimmed")
+	v3 := encrypt()
+	require.Equal(t, 3, v3.Version)
+
+	code, key := performRequest(t, http.MethodPost, "/v1/transit/keys/trimmed/trim", `{"min_available_version":"2"}`)
+	require.Equal(t, http.StatusBadRequest, code, "trim above min_decryption_version")
+	require.NotEmpty(t, key.Errors)
+
+	code, key = performRequest(t, http.MethodPut, "/v1/transit/keys/trimmed/config", `{"min_decryption_version":"2","min_encryption_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+	code, key = performRequest(t, http.MethodPost, "/v1/transit/keys/trimmed/trim", `{"min_available_version":"2"}`)
+	require.Equal(t, http.StatusOK, code, key.Errors)
+
+	keyModel, err := FindOneKey(&KeyModel{Name: "trimmed"})
+	require.NoError(t, err)
+	require.Equal(t, 2, keyModel.MinAvailableVersion)
+	require.Len(t, keyModel.Keys, 2)
+	conf, err := common.GetConfig()
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, conf.DB.Unscoped().Model(&AESKeyModel{}).Where("key_id = ? AND version = ?", keyModel.ID, 1).Count(&count).Error)
+	require.Equal(t, 0, count, "trimmed version should be deleted permanently")
+
+	w := serveRequest(http.MethodPut, "/v1/transit/decrypt/trimmed", fmt.Sprintf(`{"ciphertext":%q}`, v1.Ciphertext))
+	require.NotEqual(t, http.StatusOK, w.Code, w.Body.String())
+	w = serveRequest(http.MethodPut, "/v1/transit/decrypt/trimmed", fmt.Sprintf(`{"ciphertext":%q}`, v3.Ciphertext))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Trimmed versions can't be enabled for decryption again
+	code, key = performRequest(t, http.MethodPut, "/v1/transit/keys/trimmed/config", `{"min_decryption_version":"1"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, code)
+	require.NotEmpty(t, key.Errors)
+}
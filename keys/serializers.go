@@ -1,7 +1,10 @@
 package keys
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"github.com/miknikif/vault-auto-unseal/common"
 )
 
 type KeySerializer struct {
@@ -19,6 +22,146 @@ type DecryptDataSerializer struct {
 	AESPayload
 }
 
+type SignDataSerializer struct {
+	C *gin.Context
+	SignPayload
+}
+
+type VerifyDataSerializer struct {
+	C *gin.Context
+	SignPayload
+}
+
+type EncryptBatchSerializer struct {
+	C     *gin.Context
+	Items []BatchItem
+}
+
+type DecryptBatchSerializer struct {
+	C     *gin.Context
+	Items []BatchItem
+}
+
+type EncryptBatchItemResponse struct {
+	Ciphertext string `json:"ciphertext,omitempty"`
+	KeyVersion int    `json:"key_version,omitempty"`
+	Reference  string `json:"reference"`
+	Error      string `json:"error,omitempty"`
+}
+
+type DecryptBatchItemResponse struct {
+	Plaintext string `json:"plaintext,omitempty"`
+	Reference string `json:"reference"`
+	Error     string `json:"error,omitempty"`
+}
+
+type EncryptBatchResponse struct {
+	BatchResults []EncryptBatchItemResponse `json:"batch_results"`
+}
+
+type DecryptBatchResponse struct {
+	BatchResults []DecryptBatchItemResponse `json:"batch_results"`
+}
+
+type HMACDataSerializer struct {
+	C *gin.Context
+	HMACPayload
+}
+
+type HashDataSerializer struct {
+	C *gin.Context
+	HashPayload
+}
+
+type HMACDataResponse struct {
+	HMAC string `json:"hmac"`
+}
+
+type HashDataResponse struct {
+	Sum string `json:"sum"`
+}
+
+type SignDataResponse struct {
+	Signature  string `json:"signature"`
+	KeyVersion int    `json:"key_version"`
+}
+
+type VerifyDataResponse struct {
+	Valid bool `json:"valid"`
+}
+
+// Version of the key pair, symmetric keys are represented only by the creation time
+type ExportKeySerializer struct {
+	C    *gin.Context
+	Name string
+	Type KeyType
+	Keys map[int]string
+}
+
+type ExportKeyResponse struct {
+	Name string         `json:"name"`
+	Type KeyType        `json:"type"`
+	Keys map[int]string `json:"keys"`
+}
+
+type DataKeySerializer struct {
+	C *gin.Context
+	AESPayload
+	IncludePlaintext bool
+}
+
+type DataKeyResponse struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+	KeyVersion int    `json:"key_version"`
+}
+
+type WrappingKeySerializer struct {
+	C         *gin.Context
+	PublicKey string
+}
+
+type WrappingKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+type BackupKeySerializer struct {
+	C      *gin.Context
+	Backup string
+}
+
+type BackupKeyResponse struct {
+	Backup string `json:"backup"`
+}
+
+type KeyCacheConfigSerializer struct {
+	C    *gin.Context
+	Size int
+}
+
+type KeyCacheConfigResponse struct {
+	Size int `json:"size"`
+}
+
+type KeyCacheStatsSerializer struct {
+	C *gin.Context
+	KeyCacheStats
+}
+
+type KeyCacheStatsResponse struct {
+	Size    int     `json:"size"`
+	Entries int     `json:"entries"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+type KeyVersionResponse struct {
+	CreationTime time.Time `json:"creation_time"`
+	Name         string    `json:"name"`
+	PublicKey    string    `json:"public_key"`
+}
+
 type EncryptDataResponse struct {
 	Ciphertext string `json:"ciphertext"`
 	Version    int    `json:"version"`
@@ -29,23 +172,26 @@ type DecryptDataResponse struct {
 }
 
 type KeyResponse struct {
-	AllowPlaintextBackup bool        `json:"allow_plaintext_backup"`
-	AutoRotatePeriod     int         `json:"auto_rotate_period"`
-	DeletionAllowed      bool        `json:"deletion_allowed"`
-	Derived              bool        `json:"derived"`
-	Exportable           bool        `json:"exportable"`
-	ImportedKey          bool        `json:"imported_key"`
-	LatestVersion        int         `json:"latest_version"`
-	MinAvailableVersion  int         `json:"min_available_version"`
-	MinDecryptionVersion int         `json:"min_decryption_version"`
-	MinEncryptionVersion int         `json:"min_encryption_version"`
-	Name                 string      `json:"name"`
-	SupportsDecryption   bool        `json:"supports_decryption"`
-	SupportsDerivation   bool        `json:"supports_derivation"`
-	SupportsEncryption   bool        `json:"supports_encryption"`
-	SupportsSigning      bool        `json:"supports_signing"`
-	Type                 KeyType     `json:"type"`
-	Keys                 map[int]int `json:"keys"`
+	AllowPlaintextBackup bool                `json:"allow_plaintext_backup"`
+	AutoRotatePeriod     int                 `json:"auto_rotate_period"`
+	DeletionAllowed      bool                `json:"deletion_allowed"`
+	Derived              bool                `json:"derived"`
+	ConvergentEncryption bool                `json:"convergent_encryption"`
+	KDF                  string              `json:"kdf,omitempty"`
+	Exportable           bool                `json:"exportable"`
+	ImportedKey          bool                `json:"imported_key"`
+	AllowRotation        bool                `json:"imported_key_allow_rotation,omitempty"`
+	LatestVersion        int                 `json:"latest_version"`
+	MinAvailableVersion  int                 `json:"min_available_version"`
+	MinDecryptionVersion int                 `json:"min_decryption_version"`
+	MinEncryptionVersion int                 `json:"min_encryption_version"`
+	Name                 string              `json:"name"`
+	SupportsDecryption   bool                `json:"supports_decryption"`
+	SupportsDerivation   bool                `json:"supports_derivation"`
+	SupportsEncryption   bool                `json:"supports_encryption"`
+	SupportsSigning      bool                `json:"supports_signing"`
+	Type                 KeyType             `json:"type"`
+	Keys                 map[int]interface{} `json:"keys"`
 }
 
 type KeysSerializer struct {
@@ -73,8 +219,10 @@ func (s *KeySerializer) Response() KeyResponse {
 		AutoRotatePeriod:     s.AutoRotatePeriod,
 		DeletionAllowed:      s.DeletionAllowed,
 		Derived:              s.Derived,
+		ConvergentEncryption: s.ConvergentEncryption,
 		Exportable:           s.Exportable,
 		ImportedKey:          s.ImportedKey,
+		AllowRotation:        s.AllowImportedKeyRotation,
 		LatestVersion:        s.LatestVersion,
 		MinAvailableVersion:  s.MinAvailableVersion,
 		MinDecryptionVersion: s.MinDecryptionVersion,
@@ -85,11 +233,28 @@ func (s *KeySerializer) Response() KeyResponse {
 		SupportsEncryption:   s.SupportsEncryption,
 		SupportsSigning:      s.SupportsSigning,
 		Type:                 s.Type,
-		Keys:                 make(map[int]int),
+		Keys:                 make(map[int]interface{}),
+	}
+
+	if s.Derived {
+		response.KDF = KDF_HKDF_SHA256
 	}
 
 	for _, key := range s.Keys {
-		response.Keys[key.Version] = key.Name
+		if !s.Type.IsAsymmetric() {
+			response.Keys[key.Version] = key.Name
+			continue
+		}
+		publicKey, err := key.AESKey.publicKey(s.Type)
+		if err != nil {
+			l, _ := common.GetLogger()
+			l.Error("Unable to get public key", "name", s.Name, "version", key.Version, "error", err)
+		}
+		response.Keys[key.Version] = KeyVersionResponse{
+			CreationTime: time.Unix(int64(key.Name), 0),
+			Name:         s.Type.publicKeyName(),
+			PublicKey:    publicKey,
+		}
 	}
 
 	return response
@@ -110,3 +275,116 @@ func (s *DecryptDataSerializer) Response() DecryptDataResponse {
 	}
 	return response
 }
+
+func (s *SignDataSerializer) Response() SignDataResponse {
+	response := SignDataResponse{
+		Signature:  s.SignPayload.Signature,
+		KeyVersion: s.SignPayload.Version,
+	}
+	return response
+}
+
+func (s *VerifyDataSerializer) Response() VerifyDataResponse {
+	response := VerifyDataResponse{
+		Valid: s.SignPayload.Valid,
+	}
+	return response
+}
+
+func (s *HMACDataSerializer) Response() HMACDataResponse {
+	response := HMACDataResponse{
+		HMAC: s.HMACPayload.HMAC,
+	}
+	return response
+}
+
+func (s *HashDataSerializer) Response() HashDataResponse {
+	response := HashDataResponse{
+		Sum: s.HashPayload.Sum,
+	}
+	return response
+}
+
+func (s *EncryptBatchSerializer) Response() EncryptBatchResponse {
+	response := EncryptBatchResponse{
+		BatchResults: []EncryptBatchItemResponse{},
+	}
+	for _, item := range s.Items {
+		result := EncryptBatchItemResponse{Reference: item.Reference}
+		if item.Error != nil {
+			result.Error = item.Error.Error()
+		} else {
+			result.Ciphertext, _ = item.AESPayload.getCiphertext()
+			result.KeyVersion = item.AESPayload.Version
+		}
+		response.BatchResults = append(response.BatchResults, result)
+	}
+	return response
+}
+
+func (s *DecryptBatchSerializer) Response() DecryptBatchResponse {
+	response := DecryptBatchResponse{
+		BatchResults: []DecryptBatchItemResponse{},
+	}
+	for _, item := range s.Items {
+		result := DecryptBatchItemResponse{Reference: item.Reference}
+		if item.Error != nil {
+			result.Error = item.Error.Error()
+		} else {
+			result.Plaintext = item.AESPayload.Plaintext
+		}
+		response.BatchResults = append(response.BatchResults, result)
+	}
+	return response
+}
+
+func (s *ExportKeySerializer) Response() ExportKeyResponse {
+	return ExportKeyResponse{
+		Name: s.Name,
+		Type: s.Type,
+		Keys: s.Keys,
+	}
+}
+
+func (s *BackupKeySerializer) Response() BackupKeyResponse {
+	return BackupKeyResponse{
+		Backup: s.Backup,
+	}
+}
+
+func (s *WrappingKeySerializer) Response() WrappingKeyResponse {
+	return WrappingKeyResponse{
+		PublicKey: s.PublicKey,
+	}
+}
+
+func (s *KeyCacheConfigSerializer) Response() KeyCacheConfigResponse {
+	return KeyCacheConfigResponse{
+		Size: s.Size,
+	}
+}
+
+func (s *KeyCacheStatsSerializer) Response() KeyCacheStatsResponse {
+	response := KeyCacheStatsResponse{
+		Size:    s.Size,
+		Entries: s.Entries,
+		Hits:    s.Hits,
+		Misses:  s.Misses,
+	}
+	if total := s.Hits + s.Misses; total > 0 {
+		response.HitRate = float64(s.Hits) / float64(total)
+	}
+	return response
+}
+
+func (s *DataKeySerializer) Response() DataKeyResponse {
+	ct, _ := s.AESPayload.getCiphertext()
+	response := DataKeyResponse{
+		Ciphertext: ct,
+		KeyVersion: s.AESPayload.Version,
+	}
+	if s.IncludePlaintext {
+		response.Plaintext = s.AESPayload.Plaintext
+	}
+	return response
+}
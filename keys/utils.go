@@ -1,15 +1,37 @@
 package keys
 
 import (
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/miknikif/vault-auto-unseal/barrier"
 	"github.com/miknikif/vault-auto-unseal/common"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	_ "golang.org/x/crypto/sha3"
 )
 
 const (
@@ -18,8 +40,158 @@ const (
 	AES_KEY_SIZE_256 = 32
 )
 
+const HMAC_KEY_SIZE = 32
+
+const (
+	KDF_HKDF_SHA256           = "hkdf_sha256"
+	CONVERGENT_NONCE_KEY_SIZE = 32
+)
+
+const (
+	HASH_FORMAT_HEX    = "hex"
+	HASH_FORMAT_BASE64 = "base64"
+)
+
+const (
+	DATAKEY_TYPE_PLAINTEXT = "plaintext"
+	DATAKEY_TYPE_WRAPPED   = "wrapped"
+	DEFAULT_DATAKEY_BITS   = 256
+)
+
+const (
+	EXPORT_TYPE_ENCRYPTION_KEY = "encryption-key"
+	EXPORT_TYPE_SIGNING_KEY    = "signing-key"
+	EXPORT_TYPE_HMAC_KEY       = "hmac-key"
+)
+
+const (
+	RSA_PRIVATE_KEY_PEM_TYPE = "RSA PRIVATE KEY"
+	EC_PRIVATE_KEY_PEM_TYPE  = "EC PRIVATE KEY"
+)
+
+const (
+	RSA_KEY_BITS_2048 = 2048
+	RSA_KEY_BITS_3072 = 3072
+	RSA_KEY_BITS_4096 = 4096
+)
+
+const (
+	VERSIONED_PREFIX             = "vault:v"
+	DEFAULT_HASH_ALGORITHM       = "sha2-256"
+	SIGNATURE_ALGORITHM_PSS      = "pss"
+	SIGNATURE_ALGORITHM_PKCS1V15 = "pkcs1v15"
+	DEFAULT_SIGNATURE_ALGORITHM  = SIGNATURE_ALGORITHM_PSS
+	PUBLIC_KEY_PEM_TYPE          = "PUBLIC KEY"
+)
+
+// Hash algorithms in the Vault notation
+var hashAlgorithms = map[string]crypto.Hash{
+	"sha1":     crypto.SHA1,
+	"sha2-224": crypto.SHA224,
+	"sha2-256": crypto.SHA256,
+	"sha2-384": crypto.SHA384,
+	"sha2-512": crypto.SHA512,
+	"sha3-224": crypto.SHA3_224,
+	"sha3-256": crypto.SHA3_256,
+	"sha3-384": crypto.SHA3_384,
+	"sha3-512": crypto.SHA3_512,
+}
+
+// Get hash algorithm by its Vault name, sha2-256 is used if name is empty
+func getHashAlgorithm(name string) (crypto.Hash, error) {
+	if name == "" {
+		name = DEFAULT_HASH_ALGORITHM
+	}
+	h, ok := hashAlgorithms[name]
+	if !ok || !h.Available() {
+		return 0, fmt.Errorf("unsupported hash algorithm %q", name)
+	}
+	return h, nil
+}
+
+// Parse the value in the "vault:v<version>:<payload>" format
+func parseVersionedValue(value string) (int, string, error) {
+	if !strings.HasPrefix(value, VERSIONED_PREFIX) {
+		return 0, "", errors.New("value doesn't have the vault prefix")
+	}
+	data := strings.SplitN(strings.TrimPrefix(value, VERSIONED_PREFIX), ":", 2)
+	if len(data) != 2 {
+		return 0, "", errors.New("value doesn't have the version")
+	}
+	ver, err := strconv.Atoi(data[0])
+	if err != nil || ver < 1 {
+		return 0, "", fmt.Errorf("invalid version %q", data[0])
+	}
+	return ver, data[1], nil
+}
+
+// Encode the ciphertext in the same way as Vault does it - b64(nonce||ct)
+func encodeCiphertextPayload(ct []byte) string {
+	return base64.StdEncoding.EncodeToString(ct)
+}
+
+// Decode the ciphertext payload, legacy ciphertexts had the payload hex encoded before the b64 encoding
+// Legacy flag is returned, so the plaintext of the legacy ciphertext can be returned as it was sealed
+func decodeCiphertextPayload(payload string) ([]byte, bool, error) {
+	bs, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false, errors.New("ciphertext should be b64 encoded")
+	}
+	if isLegacyCiphertextPayload(bs) {
+		bs, err = hex.DecodeString(string(bs))
+		return bs, true, err
+	}
+	return bs, false, nil
+}
+
+// Plaintext is sealed as the decoded bytes in the same way as Vault does it
+func (s *AESPayload) decodePlaintext() ([]byte, error) {
+	pt, err := base64.StdEncoding.DecodeString(s.Plaintext)
+	if err != nil {
+		return nil, errors.New("plaintext should be b64 encoded")
+	}
+	return pt, nil
+}
+
+// Legacy ciphertexts had the b64 encoded plaintext sealed, so it's returned as is
+func (s *AESPayload) setPlaintext(pt []byte, legacy bool) {
+	if legacy {
+		s.Plaintext = string(pt)
+		return
+	}
+	s.Plaintext = base64.StdEncoding.EncodeToString(pt)
+}
+
+// Legacy payload is the lowercase hex string
+// Native payload is at least 28 bytes long (nonce and tag), so it's practically never made of the hex digits only
+func isLegacyCiphertextPayload(bs []byte) bool {
+	if len(bs) == 0 || len(bs)%2 != 0 {
+		return false
+	}
+	for _, b := range bs {
+		if (b < '0' || b > '9') && (b < 'a' || b > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 type AESKey string
 
+// Unwrap the key material with the master key and decode it
+// Plaintext key material is still accepted until it's wrapped during migration
+func (k AESKey) decode() ([]byte, error) {
+	key := string(k)
+	if barrier.IsWrapped(key) {
+		pt, err := barrier.Unwrap(key)
+		if err != nil {
+			return nil, err
+		}
+		key = string(pt)
+	}
+	return hex.DecodeString(key)
+}
+
 func generateAESKey(keySize int) (AESKey, error) {
 	var key AESKey
 	if keySize != AES_KEY_SIZE_128 && keySize != AES_KEY_SIZE_192 && keySize != AES_KEY_SIZE_256 {
@@ -29,7 +201,7 @@ func generateAESKey(keySize int) (AESKey, error) {
 	bs := make([]byte, keySize)
 
 	if _, err := rand.Read(bs); err != nil {
-		return "", nil
+		return "", err
 	}
 
 	key = AESKey(hex.EncodeToString(bs))
@@ -37,38 +209,342 @@ func generateAESKey(keySize int) (AESKey, error) {
 	return key, nil
 }
 
-func encryptDataWithAES(key AESKeyModel, aesPayload *AESPayload) error {
+func generateRSAKey(bits int) (AESKey, error) {
+	if bits != RSA_KEY_BITS_2048 && bits != RSA_KEY_BITS_3072 && bits != RSA_KEY_BITS_4096 {
+		return "", errors.New("RSA Key size must be 2048/3072/4096 bits")
+	}
+
+	pk, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", err
+	}
+
+	return AESKey(hex.EncodeToString(x509.MarshalPKCS1PrivateKey(pk))), nil
+}
+
+func generateED25519Key() (AESKey, error) {
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return marshalPrivateKey(pk)
+}
+
+func generateECDSAKey(curve elliptic.Curve) (AESKey, error) {
+	pk, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return marshalPrivateKey(pk)
+}
+
+func marshalPrivateKey(pk interface{}) (AESKey, error) {
+	bs, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return "", err
+	}
+	return AESKey(hex.EncodeToString(bs)), nil
+}
+
+// Unwrap the key material and parse it as the private key of the key pair
+// RSA keys are stored in PKCS1, all the others in PKCS8
+func (k AESKey) decodeSigner(keyType KeyType) (crypto.Signer, error) {
+	if keyType.IsRSA() {
+		return k.decodeRSA()
+	}
+	bs, err := k.decode()
+	if err != nil {
+		return nil, err
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(bs)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pk.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key material isn't a private key")
+	}
+	return signer, nil
+}
+
+// Get the public key of the key pair in the Vault format
+// ed25519 keys are b64 encoded, all the others are PEM encoded
+func (k AESKey) publicKey(keyType KeyType) (string, error) {
+	signer, err := k.decodeSigner(keyType)
+	if err != nil {
+		return "", err
+	}
+	if pub, ok := signer.Public().(ed25519.PublicKey); ok {
+		return base64.StdEncoding.EncodeToString(pub), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: PUBLIC_KEY_PEM_TYPE, Bytes: der})), nil
+}
+
+// Check if the key of the provided type could be exported as the requested export type
+func isExportSupported(keyType KeyType, exportType string) error {
+	switch exportType {
+	case EXPORT_TYPE_ENCRYPTION_KEY:
+		if !keyType.SupportsEncryption() {
+			return fmt.Errorf("encryption key export isn't supported by the %s keys", keyType)
+		}
+	case EXPORT_TYPE_SIGNING_KEY:
+		if !keyType.SupportsSigning() {
+			return fmt.Errorf("signing key export isn't supported by the %s keys", keyType)
+		}
+	case EXPORT_TYPE_HMAC_KEY:
+	default:
+		return fmt.Errorf("unknown export type %q", exportType)
+	}
+	return nil
+}
+
+// Export the key material in the Vault format
+// Symmetric, HMAC and ed25519 keys are b64 encoded, RSA and ECDSA keys are PEM encoded
+func exportKey(keyType KeyType, exportType string, key AESKeyModel) (string, error) {
+	if exportType == EXPORT_TYPE_HMAC_KEY {
+		bs, err := key.HMACKey.decode()
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(bs), nil
+	}
+	if !keyType.IsAsymmetric() {
+		bs, err := key.AESKey.decode()
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(bs), nil
+	}
+	signer, err := key.AESKey.decodeSigner(keyType)
+	if err != nil {
+		return "", err
+	}
+	switch pk := signer.(type) {
+	case ed25519.PrivateKey:
+		return base64.StdEncoding.EncodeToString(pk), nil
+	case *rsa.PrivateKey:
+		der := x509.MarshalPKCS1PrivateKey(pk)
+		return string(pem.EncodeToMemory(&pem.Block{Type: RSA_PRIVATE_KEY_PEM_TYPE, Bytes: der})), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(pk)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: EC_PRIVATE_KEY_PEM_TYPE, Bytes: der})), nil
+	default:
+		return "", errors.New("unsupported private key type")
+	}
+}
+
+// Unwrap the key material and parse it as the RSA private key
+func (k AESKey) decodeRSA() (*rsa.PrivateKey, error) {
+	bs, err := k.decode()
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKCS1PrivateKey(bs)
+}
+
+// Create the AEAD cipher for the symmetric key types
+// Keys created before the key types were introduced are AES keys
+func newAEAD(keyType KeyType, key []byte) (cipher.AEAD, error) {
+	if keyType == KEY_TYPE_CHACHA20_POLY1305 {
+		return chacha20poly1305.New(key)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt the payload with the cipher matching the key type
+func encryptData(keyModel KeyModel, key AESKeyModel, aesPayload *AESPayload) error {
+	if keyModel.Type.IsRSA() {
+		if aesPayload.AssociatedData != "" {
+			return errors.New("associated data isn't supported by the RSA keys")
+		}
+		return encryptDataWithRSA(key, aesPayload)
+	}
+	return encryptDataWithAES(keyModel, key, aesPayload)
+}
+
+// Decrypt the payload with the cipher matching the key type
+func decryptData(keyModel KeyModel, key AESKeyModel, aesPayload *AESPayload) error {
+	if keyModel.Type.IsRSA() {
+		if aesPayload.AssociatedData != "" {
+			return errors.New("associated data isn't supported by the RSA keys")
+		}
+		return decryptDataWithRSA(key, aesPayload)
+	}
+	return decryptDataWithAES(keyModel, key, aesPayload)
+}
+
+// Get the key which should be used to encrypt the payload alongside with the key of the convergent nonce
+// Derived keys are producing a per-context subkey with HKDF-SHA256, regular keys are used as is
+func getEncryptionKey(keyModel KeyModel, key AESKeyModel, context string) ([]byte, []byte, error) {
+	bsKey, err := key.AESKey.decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !keyModel.Derived {
+		return bsKey, nil, nil
+	}
+	if context == "" {
+		return nil, nil, errors.New("missing context for key derivation, the key was created as a derived key")
+	}
+	ctx, err := common.DecFromB64(context)
+	if err != nil {
+		return nil, nil, errors.New("context should be b64 encoded")
+	}
+
+	derived := make([]byte, len(bsKey)+CONVERGENT_NONCE_KEY_SIZE)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, bsKey, nil, []byte(ctx)), derived); err != nil {
+		return nil, nil, err
+	}
+	return derived[:len(bsKey)], derived[len(bsKey):], nil
+}
+
+// Convergent nonce is derived from the plaintext, so the same plaintext and context are producing the same ciphertext
+// Nonce is the same as for the version 3 convergent keys of Vault, the nonce key is derived right after the encryption key
+// Vault doesn't mix the associated data into the nonce, here it's mixed in when provided,
+// so the nonce is never reused with the different associated data
+func getConvergentNonce(nonceKey []byte, plaintext []byte, associatedData []byte, size int) []byte {
+	mac := hmac.New(sha256.New, nonceKey)
+	if len(associatedData) > 0 {
+		adLen := make([]byte, 8)
+		binary.BigEndian.PutUint64(adLen, uint64(len(associatedData)))
+		mac.Write(adLen)
+		mac.Write(associatedData)
+	}
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:size]
+}
+
+// Decode the optional associated data which is bound into the AEAD tag
+func (s *AESPayload) getAssociatedData() ([]byte, error) {
+	if s.AssociatedData == "" {
+		return nil, nil
+	}
+	ad, err := common.DecFromB64(s.AssociatedData)
+	if err != nil {
+		return nil, errors.New("associated_data should be b64 encoded")
+	}
+	return []byte(ad), nil
+}
+
+func encryptDataWithRSA(key AESKeyModel, aesPayload *AESPayload) error {
 	l, _ := common.GetLogger()
-	l.Debug("encryptDataWithAES - started", "key", key, "payload", aesPayload)
+	l.Debug("encryptDataWithRSA - started", "version", key.Version)
 	if err := aesPayload.validatePlaintext(); err != nil {
 		return err
 	}
 
-	bspt := []byte(aesPayload.Plaintext)
+	bspt, err := aesPayload.decodePlaintext()
+	if err != nil {
+		return err
+	}
+	pk, err := key.AESKey.decodeRSA()
+	if err != nil {
+		return err
+	}
 
-	bsKey, err := hex.DecodeString(string(key.AESKey))
+	ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &pk.PublicKey, bspt, nil)
 	if err != nil {
+		return fmt.Errorf("unable to encrypt the plaintext with RSA key: %w", err)
+	}
+
+	aesPayload.Payload = encodeCiphertextPayload(ct)
+	aesPayload.Pref = "vault"
+	aesPayload.Version = key.Version
+
+	if err := aesPayload.validateCiphertext(); err != nil {
+		return err
+	}
+
+	l.Debug("encryptDataWithRSA - finished", "version", key.Version)
+	return nil
+}
+
+func decryptDataWithRSA(key AESKeyModel, aesPayload *AESPayload) error {
+	l, _ := common.GetLogger()
+	l.Debug("decryptDataWithRSA - started", "version", key.Version)
+	if err := aesPayload.validateCiphertext(); err != nil {
 		return err
 	}
 
-	block, err := aes.NewCipher(bsKey)
+	pk, err := key.AESKey.decodeRSA()
+	if err != nil {
+		return err
+	}
+	enc, legacy, err := decodeCiphertextPayload(aesPayload.Payload)
 	if err != nil {
 		return err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	pt, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, pk, enc, nil)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+	aesPayload.setPlaintext(pt, legacy)
+	aesPayload.Pref = "vault"
+	aesPayload.Version = key.Version
+
+	if err := aesPayload.validatePlaintext(); err != nil {
 		return err
 	}
 
-	ct := aesGCM.Seal(nonce, nonce, bspt, nil)
+	l.Debug("decryptDataWithRSA - finished", "version", key.Version)
+	return nil
+}
 
-	aesPayload.Payload = common.EncToB64(hex.EncodeToString(ct))
+// Encrypt the payload with the AEAD cipher - AES-GCM or ChaCha20-Poly1305
+func encryptDataWithAES(keyModel KeyModel, key AESKeyModel, aesPayload *AESPayload) error {
+	l, _ := common.GetLogger()
+	l.Debug("encryptDataWithAES - started", "key", key, "payload", aesPayload)
+	if err := aesPayload.validatePlaintext(); err != nil {
+		return err
+	}
+
+	bspt, err := aesPayload.decodePlaintext()
+	if err != nil {
+		return err
+	}
+
+	bsKey, nonceKey, err := getEncryptionKey(keyModel, key, aesPayload.Context)
+	if err != nil {
+		return err
+	}
+	ad, err := aesPayload.getAssociatedData()
+	if err != nil {
+		return err
+	}
+
+	aesGCM, err := newAEAD(keyModel.Type, bsKey)
+	if err != nil {
+		return err
+	}
+
+	var nonce []byte
+	if keyModel.ConvergentEncryption {
+		nonce = getConvergentNonce(nonceKey, bspt, ad, aesGCM.NonceSize())
+	} else {
+		nonce = make([]byte, aesGCM.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+	}
+
+	ct := aesGCM.Seal(nonce, nonce, bspt, ad)
+
+	aesPayload.Payload = encodeCiphertextPayload(ct)
 	aesPayload.Pref = "vault"
 	aesPayload.Version = key.Version
 
@@ -80,45 +556,44 @@ func encryptDataWithAES(key AESKeyModel, aesPayload *AESPayload) error {
 	return nil
 }
 
-func decryptDataWithAES(key AESKeyModel, aesPayload *AESPayload) error {
+// Decrypt the payload with the AEAD cipher - AES-GCM or ChaCha20-Poly1305
+func decryptDataWithAES(keyModel KeyModel, key AESKeyModel, aesPayload *AESPayload) error {
 	l, _ := common.GetLogger()
 	l.Debug("decryptDataWithAES - started", "key", key, "payload", aesPayload)
 	if err := aesPayload.validateCiphertext(); err != nil {
 		return err
 	}
 
-	bskey, err := hex.DecodeString(string(key.AESKey))
-	if err != nil {
-		return err
-	}
-	payload, err := common.DecFromB64(aesPayload.Payload)
+	bskey, _, err := getEncryptionKey(keyModel, key, aesPayload.Context)
 	if err != nil {
 		return err
 	}
-	enc, err := hex.DecodeString(payload)
+	ad, err := aesPayload.getAssociatedData()
 	if err != nil {
 		return err
 	}
-
-	block, err := aes.NewCipher(bskey)
+	enc, legacy, err := decodeCiphertextPayload(aesPayload.Payload)
 	if err != nil {
 		return err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	aesGCM, err := newAEAD(keyModel.Type, bskey)
 	if err != nil {
 		return err
 	}
 
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return errors.New("invalid ciphertext: too short")
+	}
 	nonce, bsct := enc[:nonceSize], enc[nonceSize:]
 
-	pt, err := aesGCM.Open(nil, nonce, bsct, nil)
+	pt, err := aesGCM.Open(nil, nonce, bsct, ad)
 	if err != nil {
 		return err
 	}
 
-	aesPayload.Plaintext = string(pt[:])
+	aesPayload.setPlaintext(pt, legacy)
 	aesPayload.Pref = "vault"
 	aesPayload.Version = key.Version
 
@@ -130,8 +605,36 @@ func decryptDataWithAES(key AESKeyModel, aesPayload *AESPayload) error {
 	return nil
 }
 
-func createNewAESKeyModel(ver int, size int) (AESKeyModel, error) {
-	key, err := generateAESKey(size)
+// Create a new version of the key with the key material matching the key type
+func createNewKeyVersion(keyType KeyType, ver int) (AESKeyModel, error) {
+	var key AESKey
+	var err error
+	switch keyType {
+	case KEY_TYPE_AES128_GCM96:
+		key, err = generateAESKey(AES_KEY_SIZE_128)
+	case KEY_TYPE_AES256_GCM96:
+		key, err = generateAESKey(AES_KEY_SIZE_256)
+	case KEY_TYPE_CHACHA20_POLY1305:
+		key, err = generateAESKey(chacha20poly1305.KeySize)
+	case KEY_TYPE_RSA_2048:
+		key, err = generateRSAKey(RSA_KEY_BITS_2048)
+	case KEY_TYPE_RSA_3072:
+		key, err = generateRSAKey(RSA_KEY_BITS_3072)
+	case KEY_TYPE_RSA_4096:
+		key, err = generateRSAKey(RSA_KEY_BITS_4096)
+	case KEY_TYPE_ED25519:
+		key, err = generateED25519Key()
+	case KEY_TYPE_ECDSA_P256:
+		key, err = generateECDSAKey(elliptic.P256())
+	case KEY_TYPE_ECDSA_P384:
+		key, err = generateECDSAKey(elliptic.P384())
+	default:
+		return AESKeyModel{}, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if err != nil {
+		return AESKeyModel{}, err
+	}
+	hmacKey, err := generateAESKey(HMAC_KEY_SIZE)
 	if err != nil {
 		return AESKeyModel{}, err
 	}
@@ -139,9 +642,279 @@ func createNewAESKeyModel(ver int, size int) (AESKeyModel, error) {
 		Name:    int(time.Now().Unix()),
 		Version: ver,
 		AESKey:  key,
+		HMACKey: hmacKey,
 	}, nil
 }
 
+// Hash the input unless it's already hashed by the client
+func (s *SignPayload) digest() ([]byte, error) {
+	input, err := common.DecFromB64(s.Input)
+	if err != nil {
+		return nil, err
+	}
+	if s.Prehashed {
+		return []byte(input), nil
+	}
+	h := s.HashAlgorithm.New()
+	h.Write([]byte(input))
+	return h.Sum(nil), nil
+}
+
+// Get signer options for the key type
+// ed25519 is signing the whole message, so no hashing is performed for it
+func (s *SignPayload) signerOpts(keyType KeyType) (crypto.SignerOpts, error) {
+	if keyType == KEY_TYPE_ED25519 {
+		if s.Prehashed {
+			return nil, errors.New("prehashed input isn't supported by ed25519 keys")
+		}
+		return crypto.Hash(0), nil
+	}
+	if !keyType.IsRSA() {
+		return s.HashAlgorithm, nil
+	}
+	switch s.SignatureAlgorithm {
+	case "", SIGNATURE_ALGORITHM_PSS:
+		return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: s.HashAlgorithm}, nil
+	case SIGNATURE_ALGORITHM_PKCS1V15:
+		return s.HashAlgorithm, nil
+	}
+	return nil, fmt.Errorf("unsupported signature algorithm %q", s.SignatureAlgorithm)
+}
+
+// Get the message which should be passed to the signer
+func (s *SignPayload) message(keyType KeyType) ([]byte, error) {
+	if keyType == KEY_TYPE_ED25519 {
+		input, err := common.DecFromB64(s.Input)
+		return []byte(input), err
+	}
+	return s.digest()
+}
+
+func signData(keyType KeyType, key AESKeyModel, signPayload *SignPayload) error {
+	l, _ := common.GetLogger()
+	l.Debug("signData - started", "type", keyType, "version", key.Version)
+	if err := signPayload.validateInput(); err != nil {
+		return err
+	}
+
+	opts, err := signPayload.signerOpts(keyType)
+	if err != nil {
+		return err
+	}
+	msg, err := signPayload.message(keyType)
+	if err != nil {
+		return err
+	}
+	signer, err := key.AESKey.decodeSigner(keyType)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signer.Sign(rand.Reader, msg, opts)
+	if err != nil {
+		return err
+	}
+
+	signPayload.Version = key.Version
+	signPayload.Signature = signPayload.getSignature(sig)
+
+	l.Debug("signData - finished", "type", keyType, "version", key.Version)
+	return nil
+}
+
+func verifySignature(keyType KeyType, key AESKeyModel, signPayload *SignPayload, sig []byte) error {
+	l, _ := common.GetLogger()
+	l.Debug("verifySignature - started", "type", keyType, "version", key.Version)
+	if err := signPayload.validateInput(); err != nil {
+		return err
+	}
+
+	opts, err := signPayload.signerOpts(keyType)
+	if err != nil {
+		return err
+	}
+	msg, err := signPayload.message(keyType)
+	if err != nil {
+		return err
+	}
+	signer, err := key.AESKey.decodeSigner(keyType)
+	if err != nil {
+		return err
+	}
+
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		signPayload.Valid = ed25519.Verify(pub, msg, sig)
+	case *ecdsa.PublicKey:
+		signPayload.Valid = ecdsa.VerifyASN1(pub, msg, sig)
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			signPayload.Valid = rsa.VerifyPSS(pub, pss.Hash, msg, sig, pss) == nil
+		} else {
+			signPayload.Valid = rsa.VerifyPKCS1v15(pub, opts.HashFunc(), msg, sig) == nil
+		}
+	default:
+		return errors.New("key type doesn't support signature verification")
+	}
+
+	l.Debug("verifySignature - finished", "type", keyType, "version", key.Version, "valid", signPayload.Valid)
+	return nil
+}
+
+func computeHMAC(key AESKeyModel, hashAlgorithm crypto.Hash, input string) ([]byte, error) {
+	if key.HMACKey == "" {
+		return nil, fmt.Errorf("HMAC key for the version v%d doesn't exist", key.Version)
+	}
+	bsKey, err := key.HMACKey.decode()
+	if err != nil {
+		return nil, err
+	}
+	data, err := common.DecFromB64(input)
+	if err != nil {
+		return nil, errors.New("input should be b64 encoded")
+	}
+	mac := hmac.New(hashAlgorithm.New, bsKey)
+	mac.Write([]byte(data))
+	return mac.Sum(nil), nil
+}
+
+func hmacData(key AESKeyModel, hmacPayload *HMACPayload) error {
+	l, _ := common.GetLogger()
+	l.Debug("hmacData - started", "version", key.Version)
+	mac, err := computeHMAC(key, hmacPayload.HashAlgorithm, hmacPayload.Input)
+	if err != nil {
+		return err
+	}
+	hmacPayload.Version = key.Version
+	hmacPayload.HMAC = fmt.Sprintf("%s%d:%s", VERSIONED_PREFIX, key.Version, base64.StdEncoding.EncodeToString(mac))
+	l.Debug("hmacData - finished", "version", key.Version)
+	return nil
+}
+
+// Verify HMAC of the input, the result is stored in the same way as for the signatures
+func verifyHMAC(key AESKeyModel, signPayload *SignPayload, mac []byte) error {
+	expected, err := computeHMAC(key, signPayload.HashAlgorithm, signPayload.Input)
+	if err != nil {
+		return err
+	}
+	signPayload.Valid = hmac.Equal(expected, mac)
+	return nil
+}
+
+func hashData(hashPayload *HashPayload) error {
+	input, err := common.DecFromB64(hashPayload.Input)
+	if err != nil {
+		return errors.New("input should be b64 encoded")
+	}
+	h := hashPayload.HashAlgorithm.New()
+	h.Write([]byte(input))
+	switch hashPayload.Format {
+	case "", HASH_FORMAT_HEX:
+		hashPayload.Sum = hex.EncodeToString(h.Sum(nil))
+	case HASH_FORMAT_BASE64:
+		hashPayload.Sum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	default:
+		return fmt.Errorf("unsupported encoding format %q", hashPayload.Format)
+	}
+	return nil
+}
+
+// Get the version of the key which should be used for encryption
+// The latest version is used if no version was requested
+func getEncryptionVersion(keyModel KeyModel, requested int) (int, error) {
+	if requested == 0 {
+		return keyModel.LatestVersion, nil
+	}
+	if requested < keyModel.MinEncryptionVersion {
+		return 0, fmt.Errorf("requested key version v%d is lower than the min encryption version v%d", requested, keyModel.MinEncryptionVersion)
+	}
+	if requested > keyModel.LatestVersion {
+		return 0, fmt.Errorf("requested key version v%d is higher than the latest version v%d", requested, keyModel.LatestVersion)
+	}
+	return requested, nil
+}
+
+// Generate the random data key, it's b64 encoded and could be encrypted as any other plaintext
+func generateDataKey(bits int) (string, error) {
+	bs := make([]byte, bits/8)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bs), nil
+}
+
+// Encrypt the payload with the requested version of the key
+func encryptPayload(keyModel KeyModel, aesPayload *AESPayload) error {
+	version, err := getEncryptionVersion(keyModel, aesPayload.KeyVersion)
+	if err != nil {
+		return err
+	}
+	key, err := findKeyVersion(keyModel.Keys, version)
+	if err != nil {
+		return fmt.Errorf("key version v%d doesn't exist", version)
+	}
+	return encryptData(keyModel, key, aesPayload)
+}
+
+// Decrypt the payload with the version of the key it was encrypted with
+func decryptPayload(keyModel KeyModel, aesPayload *AESPayload) error {
+	if aesPayload.Version < keyModel.MinDecryptionVersion {
+		return fmt.Errorf("minimum version to decrypt is v%d, but you're requested v%d to be decrypted", keyModel.MinDecryptionVersion, aesPayload.Version)
+	}
+	key, err := findKeyVersion(keyModel.Keys, aesPayload.Version)
+	if err != nil {
+		return fmt.Errorf("key version v%d doesn't exist", aesPayload.Version)
+	}
+	return decryptData(keyModel, key, aesPayload)
+}
+
+// Decrypt the payload and encrypt it again with the requested version of the key
+func rewrapPayload(keyModel KeyModel, aesPayload *AESPayload) error {
+	if err := decryptPayload(keyModel, aesPayload); err != nil {
+		return err
+	}
+	return encryptPayload(keyModel, aesPayload)
+}
+
+// Process the batch items concurrently on the pool of workers
+// Items which already failed validation are skipped
+func processBatch(items []BatchItem, fn func(*AESPayload) error) {
+	workers := runtime.NumCPU()
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				items[i].Error = fn(&items[i].AESPayload)
+			}
+		}()
+	}
+
+	for i := range items {
+		if items[i].Error == nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Check if all the batch items failed
+func batchFailed(items []BatchItem) bool {
+	for _, item := range items {
+		if item.Error == nil {
+			return false
+		}
+	}
+	return true
+}
+
 func findKeyVersion(keys []AESKeyModel, version int) (AESKeyModel, error) {
 	for _, key := range keys {
 		if key.Version == version {
@@ -0,0 +1,218 @@
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/hkdf"
+)
+
+func TestParseCiphertext(t *testing.T) {
+	tests := []struct {
+		ciphertext string
+		version    int
+		payload    string
+		valid      bool
+	}{
+		{ciphertext: "vault:v1:dGVzdA==", version: 1, payload: "dGVzdA==", valid: true},
+		{ciphertext: "vault:v10:dGVzdA==", version: 10, payload: "dGVzdA==", valid: true},
+		{ciphertext: "vault:v123:dGVzdA==", version: 123, payload: "dGVzdA==", valid: true},
+		{ciphertext: "vault:v0:dGVzdA=="},
+		{ciphertext: "vault:vx:dGVzdA=="},
+		{ciphertext: "vault:v1"},
+		{ciphertext: "vault:v1:"},
+		{ciphertext: "other:v1:dGVzdA=="},
+		{ciphertext: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ciphertext, func(t *testing.T) {
+			aesPayload, err := parseCiphertext(tt.ciphertext, "", "")
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.version, aesPayload.Version)
+			require.Equal(t, tt.payload, aesPayload.Payload)
+			ct, err := aesPayload.getCiphertext()
+			require.NoError(t, err)
+			require.Equal(t, tt.ciphertext, ct)
+		})
+	}
+}
+
+func TestDecodeCiphertextPayload(t *testing.T) {
+	raw := []byte{0x00, 0x01, 0xfe, 0xff, 'a', '1'}
+
+	bs, legacy, err := decodeCiphertextPayload(base64.StdEncoding.EncodeToString(raw))
+	require.NoError(t, err)
+	require.False(t, legacy)
+	require.Equal(t, raw, bs)
+
+	bs, legacy, err = decodeCiphertextPayload(base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(raw))))
+	require.NoError(t, err)
+	require.True(t, legacy)
+	require.Equal(t, raw, bs)
+
+	_, _, err = decodeCiphertextPayload("not b64")
+	require.Error(t, err)
+}
+
+// Ciphertexts produced before the native format was introduced should still be decrypted
+// Legacy ciphertexts had the b64 encoded plaintext sealed, so the sealed text is returned as is
+func TestDecryptData_Formats(t *testing.T) {
+	for _, keyType := range []KeyType{KEY_TYPE_AES256_GCM96, KEY_TYPE_CHACHA20_POLY1305, KEY_TYPE_RSA_2048} {
+		t.Run(string(keyType), func(t *testing.T) {
+			name := "format-" + string(keyType)
+			createTestKey(t, name, fmt.Sprintf(`{"type":%q}`, keyType))
+			code, res := encryptTestData(name)
+			require.Equal(t, http.StatusOK, code, res.Errors)
+
+			// Vault format is b64(nonce||ct) without any intermediate encoding
+			payload := strings.TrimPrefix(res.Data.Ciphertext, "vault:v1:")
+			raw, err := base64.StdEncoding.DecodeString(payload)
+			require.NoError(t, err)
+			require.False(t, isLegacyCiphertextPayload(raw))
+
+			w := serveRequest(http.MethodPut, "/v1/transit/decrypt/"+name, fmt.Sprintf(`{"ciphertext":%q}`, res.Data.Ciphertext))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.Contains(t, w.Body.String(), `"plaintext":"dGVzdA=="`)
+
+			// Legacy ciphertext of "dGVzdA==" is the same as the native ciphertext of its b64 encoding
+			w = serveRequest(http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":%q}`, base64.StdEncoding.EncodeToString([]byte("dGVzdA=="))))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			raw, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(res.Data.Ciphertext, "vault:v1:"))
+			require.NoError(t, err)
+			legacy := "vault:v1:" + base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(raw)))
+			w = serveRequest(http.MethodPut, "/v1/transit/decrypt/"+name, fmt.Sprintf(`{"ciphertext":%q}`, legacy))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.Contains(t, w.Body.String(), `"plaintext":"dGVzdA=="`)
+		})
+	}
+}
+
+// Decoded plaintext is sealed, so the ciphertext can be opened with the raw key in the same way as Vault does it
+func TestEncryptData_SealsDecodedPlaintext(t *testing.T) {
+	createTestKey(t, "sealed", "{}")
+	code, res := encryptTestData("sealed")
+	require.Equal(t, http.StatusOK, code, res.Errors)
+
+	keyModel, err := FindCachedKey("sealed")
+	require.NoError(t, err)
+	key, err := keyModel.Keys[0].AESKey.decode()
+	require.NoError(t, err)
+	aead, err := newAEAD(keyModel.Type, key)
+	require.NoError(t, err)
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(res.Data.Ciphertext, "vault:v1:"))
+	require.NoError(t, err)
+	pt, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	require.NoError(t, err)
+	require.Equal(t, "test", string(pt))
+}
+
+// Convergent ciphertext is the same as the one produced by Vault for the version 3 convergent keys
+func TestEncryptData_ConvergentNonce(t *testing.T) {
+	context := base64.StdEncoding.EncodeToString([]byte("host-1"))
+	for _, keyType := range []KeyType{KEY_TYPE_AES128_GCM96, KEY_TYPE_AES256_GCM96, KEY_TYPE_CHACHA20_POLY1305} {
+		t.Run(string(keyType), func(t *testing.T) {
+			name := "convergent-" + string(keyType)
+			createTestKey(t, name, fmt.Sprintf(`{"type":%q,"derived":true,"convergent_encryption":true}`, keyType))
+			var res EncryptDataResponse
+			code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":"dGVzdA==","context":%q}`, context), &res)
+			require.Equal(t, http.StatusOK, code, errs)
+
+			keyModel, err := FindCachedKey(name)
+			require.NoError(t, err)
+			key, err := keyModel.Keys[0].AESKey.decode()
+			require.NoError(t, err)
+			derived := make([]byte, len(key)+sha256.Size)
+			_, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("host-1")), derived)
+			require.NoError(t, err)
+			aead, err := newAEAD(keyType, derived[:len(key)])
+			require.NoError(t, err)
+			mac := hmac.New(sha256.New, derived[len(key):])
+			mac.Write([]byte("test"))
+			nonce := mac.Sum(nil)[:aead.NonceSize()]
+			require.Equal(t, "vault:v1:"+base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("test"), nil)), res.Ciphertext)
+
+			// Associated data is mixed into the nonce, so the nonce isn't reused with the different associated data
+			var withAD EncryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":"dGVzdA==","context":%q,"associated_data":"YWQ="}`, context), &withAD)
+			require.Equal(t, http.StatusOK, code, errs)
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(withAD.Ciphertext, "vault:v1:"))
+			require.NoError(t, err)
+			require.NotEqual(t, nonce, raw[:aead.NonceSize()])
+			pt, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte("ad"))
+			require.NoError(t, err)
+			require.Equal(t, "test", string(pt))
+		})
+	}
+}
+
+// Associated data is bound into the AEAD tag, so the ciphertext is decrypted only with the same associated data
+func TestEncryptData_AssociatedData(t *testing.T) {
+	ad := base64.StdEncoding.EncodeToString([]byte("host-1"))
+	other := base64.StdEncoding.EncodeToString([]byte("host-2"))
+	for _, keyType := range []KeyType{KEY_TYPE_AES128_GCM96, KEY_TYPE_AES256_GCM96, KEY_TYPE_CHACHA20_POLY1305} {
+		t.Run(string(keyType), func(t *testing.T) {
+			name := "ad-" + string(keyType)
+			createTestKey(t, name, fmt.Sprintf(`{"type":%q}`, keyType))
+			decrypt := func(ciphertext string, fields string) (int, DecryptDataResponse) {
+				var res DecryptDataResponse
+				code, _ := performDataRequest(t, http.MethodPut, "/v1/transit/decrypt/"+name, fmt.Sprintf(`{"ciphertext":%q%s}`, ciphertext, fields), &res)
+				return code, res
+			}
+
+			var encrypted EncryptDataResponse
+			code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, fmt.Sprintf(`{"plaintext":"dGVzdA==","associated_data":%q}`, ad), &encrypted)
+			require.Equal(t, http.StatusOK, code, errs)
+			code, decrypted := decrypt(encrypted.Ciphertext, fmt.Sprintf(`,"associated_data":%q`, ad))
+			require.Equal(t, http.StatusOK, code)
+			require.Equal(t, "dGVzdA==", decrypted.Plaintext)
+
+			code, _ = decrypt(encrypted.Ciphertext, "")
+			require.NotEqual(t, http.StatusOK, code, "missing associated data")
+			code, _ = decrypt(encrypted.Ciphertext, fmt.Sprintf(`,"associated_data":%q`, other))
+			require.NotEqual(t, http.StatusOK, code, "different associated data")
+			code, _ = decrypt(encrypted.Ciphertext, `,"associated_data":"not b64!"`)
+			require.NotEqual(t, http.StatusOK, code, "invalid associated data")
+
+			// Ciphertext without the associated data can't be decrypted with it
+			var plain EncryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, `{"plaintext":"dGVzdA=="}`, &plain)
+			require.Equal(t, http.StatusOK, code, errs)
+			code, _ = decrypt(plain.Ciphertext, fmt.Sprintf(`,"associated_data":%q`, ad))
+			require.NotEqual(t, http.StatusOK, code)
+			code, decrypted = decrypt(plain.Ciphertext, "")
+			require.Equal(t, http.StatusOK, code)
+			require.Equal(t, "dGVzdA==", decrypted.Plaintext)
+
+			// Rewrapped ciphertext is still bound to the same associated data
+			rotateTestKey(t, name)
+			var rewrapped EncryptDataResponse
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/rewrap/"+name, fmt.Sprintf(`{"ciphertext":%q,"associated_data":%q}`, encrypted.Ciphertext, ad), &rewrapped)
+			require.Equal(t, http.StatusOK, code, errs)
+			require.True(t, strings.HasPrefix(rewrapped.Ciphertext, "vault:v2:"), rewrapped.Ciphertext)
+			code, _ = decrypt(rewrapped.Ciphertext, "")
+			require.NotEqual(t, http.StatusOK, code)
+			code, decrypted = decrypt(rewrapped.Ciphertext, fmt.Sprintf(`,"associated_data":%q`, ad))
+			require.Equal(t, http.StatusOK, code)
+			require.Equal(t, "dGVzdA==", decrypted.Plaintext)
+
+			code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/"+name, `{"plaintext":"dGVzdA==","associated_data":"not b64!"}`, nil)
+			require.NotEqual(t, http.StatusOK, code)
+			require.NotEmpty(t, errs)
+		})
+	}
+}
@@ -1,35 +1,159 @@
 package keys
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/miknikif/vault-auto-unseal/common"
 )
 
 type KeyModelValidator struct {
-	AllowPlaintextBackup bool     `json:"allow_plaintext_backup"`
-	AutoRotatePeriod     string   `json:"auto_rotate_period"`
-	DeletionAllowed      string   `json:"deletion_allowed"`
-	Derived              string   `json:"derived"`
-	Exportable           string   `json:"exportable"`
-	MinDecryptionVersion string   `json:"min_decryption_version"`
-	MinEncryptionVersion string   `json:"min_encryption_version"`
-	Name                 string   `json:"-"`
-	Type                 KeyType  `json:"type"`
-	keyModel             KeyModel `json:"-"`
+	AllowPlaintextBackup bool                 `json:"allow_plaintext_backup"`
+	AutoRotatePeriod     string               `json:"auto_rotate_period"`
+	DeletionAllowed      common.OptionalField `json:"deletion_allowed"`
+	Derived              common.OptionalField `json:"derived"`
+	ConvergentEncryption common.OptionalField `json:"convergent_encryption"`
+	Exportable           common.OptionalField `json:"exportable"`
+	MinDecryptionVersion string               `json:"min_decryption_version"`
+	MinEncryptionVersion string               `json:"min_encryption_version"`
+	Name                 string               `json:"-"`
+	Type                 KeyType              `json:"type"`
+	keyModel             KeyModel             `json:"-"`
+}
+
+// Fields are optional, so it's possible to tell which of them were sent
+type KeyConfigValidator struct {
+	AllowPlaintextBackup common.OptionalField   `json:"allow_plaintext_backup"`
+	AutoRotatePeriod     common.OptionalField   `json:"auto_rotate_period"`
+	DeletionAllowed      common.OptionalField   `json:"deletion_allowed"`
+	Exportable           common.OptionalField   `json:"exportable"`
+	MinDecryptionVersion common.OptionalField   `json:"min_decryption_version"`
+	MinEncryptionVersion common.OptionalField   `json:"min_encryption_version"`
+	keyModel             KeyModel               `json:"-"`
+	updates              map[string]interface{} `json:"-"`
+}
+
+type KeyCacheConfigValidator struct {
+	Size common.OptionalField `json:"size"`
+	size int
+}
+
+type KeyTrimValidator struct {
+	MinAvailableVersion string   `json:"min_available_version"`
+	keyModel            KeyModel `json:"-"`
+	minAvailableVersion int
+}
+
+type DataKeyValidator struct {
+	Bits           common.OptionalField `json:"bits"`
+	Context        string               `json:"context"`
+	AssociatedData string               `json:"associated_data"`
+	aesPayload     AESPayload
+	plaintext      bool
+}
+
+type KeyImportValidator struct {
+	Ciphertext           string               `json:"ciphertext"`
+	HashFunction         string               `json:"hash_function"`
+	Type                 KeyType              `json:"type"`
+	AllowRotation        common.OptionalField `json:"allow_rotation"`
+	AllowPlaintextBackup common.OptionalField `json:"allow_plaintext_backup"`
+	AutoRotatePeriod     string               `json:"auto_rotate_period"`
+	DeletionAllowed      common.OptionalField `json:"deletion_allowed"`
+	Derived              common.OptionalField `json:"derived"`
+	Exportable           common.OptionalField `json:"exportable"`
+	Name                 string               `json:"-"`
+	keyModel             KeyModel             `json:"-"`
+	material             []byte
+}
+
+type KeyImportVersionValidator struct {
+	Ciphertext   string   `json:"ciphertext"`
+	HashFunction string   `json:"hash_function"`
+	keyModel     KeyModel `json:"-"`
+	material     []byte
+}
+
+type KeyRestoreValidator struct {
+	Backup   string               `json:"backup"`
+	Name     string               `json:"name"`
+	Force    common.OptionalField `json:"force"`
+	keyModel KeyModel             `json:"-"`
+	force    bool
+}
+
+type EncryptBatchItemValidator struct {
+	Plaintext      string               `json:"plaintext"`
+	Context        string               `json:"context"`
+	AssociatedData string               `json:"associated_data"`
+	KeyVersion     common.OptionalField `json:"key_version"`
+	Reference      string               `json:"reference"`
+}
+
+type DecryptBatchItemValidator struct {
+	Ciphertext     string `json:"ciphertext"`
+	Context        string `json:"context"`
+	AssociatedData string `json:"associated_data"`
+	Reference      string `json:"reference"`
 }
 
 type EncryptDataValidator struct {
-	Plaintext  string `json:"plaintext"`
-	aesPayload AESPayload
+	Plaintext      string                      `json:"plaintext"`
+	Context        string                      `json:"context"`
+	AssociatedData string                      `json:"associated_data"`
+	KeyVersion     common.OptionalField        `json:"key_version"`
+	BatchInput     []EncryptBatchItemValidator `json:"batch_input"`
+	aesPayload     AESPayload
+	batchItems     []BatchItem
 }
 
 type DecryptDataValidator struct {
-	Ciphertext string `json:"ciphertext"`
-	aesPayload AESPayload
+	Ciphertext     string                      `json:"ciphertext"`
+	Context        string                      `json:"context"`
+	AssociatedData string                      `json:"associated_data"`
+	KeyVersion     common.OptionalField        `json:"key_version"` // used only by rewrap
+	BatchInput     []DecryptBatchItemValidator `json:"batch_input"`
+	aesPayload     AESPayload
+	batchItems     []BatchItem
+}
+
+type SignDataValidator struct {
+	Input              string               `json:"input"`
+	HashAlgorithm      string               `json:"hash_algorithm"`
+	SignatureAlgorithm string               `json:"signature_algorithm"`
+	Prehashed          string               `json:"prehashed"`
+	KeyVersion         common.OptionalField `json:"key_version"`
+	signPayload        SignPayload
+}
+
+type VerifyDataValidator struct {
+	Input              string `json:"input"`
+	Signature          string `json:"signature"`
+	HMAC               string `json:"hmac"`
+	HashAlgorithm      string `json:"hash_algorithm"`
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	Prehashed          string `json:"prehashed"`
+	signPayload        SignPayload
+	signature          []byte
+	isHMAC             bool
+}
+
+type HMACDataValidator struct {
+	Input       string               `json:"input"`
+	Algorithm   string               `json:"algorithm"`
+	KeyVersion  common.OptionalField `json:"key_version"`
+	hmacPayload HMACPayload
+}
+
+type HashDataValidator struct {
+	Input       string `json:"input"`
+	Algorithm   string `json:"algorithm"`
+	Format      string `json:"format"`
+	hashPayload HashPayload
 }
 
 func (s *KeyModelValidator) Bind(c *gin.Context) error {
@@ -39,48 +163,58 @@ func (s *KeyModelValidator) Bind(c *gin.Context) error {
 		return err
 	}
 
-	s.keyModel.AllowPlaintextBackup = false
-	s.keyModel.AutoRotatePeriod = 0
-	s.keyModel.DeletionAllowed = false
-	s.keyModel.Derived = false
-	s.keyModel.Exportable = false
-	s.keyModel.ImportedKey = false
-	s.keyModel.MinAvailableVersion = 1
-	s.keyModel.MinDecryptionVersion = 1
-	s.keyModel.MinEncryptionVersion = 1
-	s.keyModel.SupportsDecryption = true
-	s.keyModel.SupportsDerivation = false
-	s.keyModel.SupportsEncryption = true
-	s.keyModel.SupportsSigning = false
-	s.keyModel.Type = KEY_TYPE_AES256_GCM96
-
-	autoRotatePeriod := common.ParseInt(s.AutoRotatePeriod, 0)
+	keyType := s.Type
+	if keyType == "" {
+		keyType = KEY_TYPE_AES256_GCM96
+	}
+	if !keyType.IsValid() {
+		return fmt.Errorf("unknown key type %q", keyType)
+	}
+	s.keyModel.Type = keyType
+	s.keyModel.SupportsDecryption = keyType.SupportsEncryption()
+	s.keyModel.SupportsEncryption = keyType.SupportsEncryption()
+	s.keyModel.SupportsSigning = keyType.SupportsSigning()
+	s.keyModel.SupportsDerivation = keyType.SupportsDerivation()
+
+	autoRotatePeriod, err := common.ParseDurationSeconds(s.AutoRotatePeriod)
+	if err != nil {
+		return fmt.Errorf("invalid auto_rotate_period: %w", err)
+	}
+	if autoRotatePeriod != 0 && autoRotatePeriod < MIN_AUTO_ROTATE_PERIOD {
+		return errors.New("auto_rotate_period should be 0 to disable rotation, or at least 1h")
+	}
 	minDecryptionVersion := common.ParseInt(s.MinDecryptionVersion, 1)
 	minEncryptionVersion := common.ParseInt(s.MinEncryptionVersion, 1)
-	deletionAllowed := common.ParseBool(s.DeletionAllowed, false)
-	derived := common.ParseBool(s.Derived, false)
-	exportable := common.ParseBool(s.Exportable, false)
+	deletionAllowed := common.ParseBool(s.DeletionAllowed.Value, false)
+	derived := common.ParseBool(s.Derived.Value, false)
+	convergent := common.ParseBool(s.ConvergentEncryption.Value, false)
+	exportable := common.ParseBool(s.Exportable.Value, false)
+
+	if derived && !keyType.SupportsDerivation() {
+		return fmt.Errorf("key derivation isn't supported by the %s keys", keyType)
+	}
+	if convergent && !derived {
+		return errors.New("convergent encryption requires derivation to be enabled")
+	}
 
 	s.keyModel.AllowPlaintextBackup = s.AllowPlaintextBackup
 	s.keyModel.AutoRotatePeriod = autoRotatePeriod
 	s.keyModel.DeletionAllowed = deletionAllowed
 	s.keyModel.Derived = derived
+	s.keyModel.ConvergentEncryption = convergent
 	s.keyModel.Exportable = exportable
+	s.keyModel.MinAvailableVersion = 1
 	s.keyModel.MinDecryptionVersion = minDecryptionVersion
 	s.keyModel.MinEncryptionVersion = minEncryptionVersion
 	s.keyModel.Name = s.Name
 
-	if s.keyModel.Keys == nil || len(s.keyModel.Keys) < 1 {
-		key, err := createNewAESKeyModel(1, AES_KEY_SIZE_256)
-		if err != nil {
-			return err
-		}
-
-		s.keyModel.Keys = []AESKeyModel{key}
+	key, err := createNewKeyVersion(keyType, 1)
+	if err != nil {
+		return err
 	}
-
-	s.keyModel.LatestVersion = len(s.keyModel.Keys)
-	if minDecryptionVersion > len(s.keyModel.Keys) || minEncryptionVersion > len(s.keyModel.Keys) {
+	s.keyModel.Keys = []AESKeyModel{key}
+	s.keyModel.LatestVersion = key.Version
+	if minDecryptionVersion != 1 || minEncryptionVersion != 1 {
 		return errors.New("MinEncryptionVersion and MinDecryptionVersion are referencing not existing keys")
 	}
 
@@ -93,19 +227,101 @@ func NewKeyModelValidator() KeyModelValidator {
 	return KeyModelValidator{}
 }
 
-func NewKeyModelValidatorFillWith(keyModel KeyModel) KeyModelValidator {
-	keyModelValidator := NewKeyModelValidator()
-	keyModelValidator.Name = keyModel.Name
-	keyModelValidator.AllowPlaintextBackup = keyModel.AllowPlaintextBackup
-	keyModelValidator.AutoRotatePeriod = fmt.Sprint(keyModel.AutoRotatePeriod)
-	keyModelValidator.DeletionAllowed = fmt.Sprint(keyModel.DeletionAllowed)
-	keyModelValidator.Derived = fmt.Sprint(keyModel.Derived)
-	keyModelValidator.Exportable = fmt.Sprint(keyModel.Exportable)
-	keyModelValidator.MinDecryptionVersion = fmt.Sprint(keyModel.MinDecryptionVersion)
-	keyModelValidator.MinEncryptionVersion = fmt.Sprint(keyModel.MinEncryptionVersion)
-	keyModelValidator.Type = keyModel.Type
-	keyModelValidator.keyModel.Keys = keyModel.Keys
-	return keyModelValidator
+func NewKeyConfigValidatorFillWith(keyModel KeyModel) KeyConfigValidator {
+	return KeyConfigValidator{keyModel: keyModel, updates: make(map[string]interface{})}
+}
+
+// Only the fields present in the request are changed, the rest of the key config is left as is
+// Changed columns are collected to the updates, so the false and 0 values are saved as well
+func (s *KeyConfigValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if s.DeletionAllowed.Set {
+		deletionAllowed, err := strconv.ParseBool(s.DeletionAllowed.Value)
+		if err != nil {
+			return errors.New("deletion_allowed should be a boolean")
+		}
+		s.keyModel.DeletionAllowed = deletionAllowed
+		s.updates["deletion_allowed"] = deletionAllowed
+	}
+
+	// Key material could be already exported, so exportable can't be disabled again
+	if s.Exportable.Set {
+		exportable, err := strconv.ParseBool(s.Exportable.Value)
+		if err != nil {
+			return errors.New("exportable should be a boolean")
+		}
+		if s.keyModel.Exportable && !exportable {
+			return errors.New("exportable can't be disabled once it was enabled")
+		}
+		s.keyModel.Exportable = exportable
+		s.updates["exportable"] = exportable
+	}
+
+	if s.AllowPlaintextBackup.Set {
+		allowPlaintextBackup, err := strconv.ParseBool(s.AllowPlaintextBackup.Value)
+		if err != nil {
+			return errors.New("allow_plaintext_backup should be a boolean")
+		}
+		if s.keyModel.AllowPlaintextBackup && !allowPlaintextBackup {
+			return errors.New("allow_plaintext_backup can't be disabled once it was enabled")
+		}
+		s.keyModel.AllowPlaintextBackup = allowPlaintextBackup
+		s.updates["allow_plaintext_backup"] = allowPlaintextBackup
+	}
+
+	if s.AutoRotatePeriod.Set {
+		autoRotatePeriod, err := common.ParseDurationSeconds(s.AutoRotatePeriod.Value)
+		if err != nil {
+			return fmt.Errorf("invalid auto_rotate_period: %w", err)
+		}
+		if autoRotatePeriod != 0 && autoRotatePeriod < MIN_AUTO_ROTATE_PERIOD {
+			return errors.New("auto_rotate_period should be 0 to disable rotation, or at least 1h")
+		}
+		if autoRotatePeriod != 0 && s.keyModel.ImportedKey && !s.keyModel.AllowImportedKeyRotation {
+			return errors.New("auto_rotate_period can't be set for the imported key, rotation wasn't allowed during the import")
+		}
+		s.keyModel.AutoRotatePeriod = autoRotatePeriod
+		s.updates["auto_rotate_period"] = autoRotatePeriod
+	}
+
+	if s.MinDecryptionVersion.Set {
+		minDecryptionVersion, err := strconv.Atoi(s.MinDecryptionVersion.Value)
+		if err != nil {
+			return errors.New("min_decryption_version should be an integer")
+		}
+		s.keyModel.MinDecryptionVersion = minDecryptionVersion
+		s.updates["min_decryption_version"] = minDecryptionVersion
+	}
+
+	if s.MinEncryptionVersion.Set {
+		minEncryptionVersion, err := strconv.Atoi(s.MinEncryptionVersion.Value)
+		if err != nil {
+			return errors.New("min_encryption_version should be an integer")
+		}
+		s.keyModel.MinEncryptionVersion = minEncryptionVersion
+		s.updates["min_encryption_version"] = minEncryptionVersion
+	}
+
+	if s.MinDecryptionVersion.Set || s.MinEncryptionVersion.Set {
+		minDecryptionVersion := s.keyModel.MinDecryptionVersion
+		minEncryptionVersion := s.keyModel.MinEncryptionVersion
+		if minDecryptionVersion > s.keyModel.LatestVersion || minEncryptionVersion > s.keyModel.LatestVersion {
+			return errors.New("MinEncryptionVersion and MinDecryptionVersion are referencing not existing keys")
+		}
+		if minDecryptionVersion < s.keyModel.MinAvailableVersion || minEncryptionVersion < s.keyModel.MinAvailableVersion {
+			return fmt.Errorf("MinEncryptionVersion and MinDecryptionVersion can't be lower than the min available version v%d", s.keyModel.MinAvailableVersion)
+		}
+		// Lowest min_encryption_version doesn't restrict anything, the same as 0 in Vault
+		if minEncryptionVersion > s.keyModel.MinAvailableVersion && minEncryptionVersion < minDecryptionVersion {
+			return fmt.Errorf("min encryption version of %d must be greater than or equal to min decryption version of %d", minEncryptionVersion, minDecryptionVersion)
+		}
+	}
+
+	return nil
 }
 
 func NewEncryptDataValidator() EncryptDataValidator {
@@ -119,6 +335,27 @@ func (s *EncryptDataValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	// Batch items are validated one by one during processing, so a single bad item isn't failing the whole batch
+	if s.isBatch() {
+		keyVersion, err := parseKeyVersion(s.KeyVersion.Value)
+		if err != nil {
+			return err
+		}
+		for _, item := range s.BatchInput {
+			aesPayload := AESPayload{Plaintext: item.Plaintext, Context: item.Context, AssociatedData: item.AssociatedData, KeyVersion: keyVersion}
+			itemKeyVersion, err := parseKeyVersion(item.KeyVersion.Value)
+			if itemKeyVersion != 0 {
+				aesPayload.KeyVersion = itemKeyVersion
+			}
+			s.batchItems = append(s.batchItems, BatchItem{
+				AESPayload: aesPayload,
+				Reference:  item.Reference,
+				Error:      err,
+			})
+		}
+		l.Debug("EncryptDataValidator.Bind - end", "batch_size", len(s.batchItems))
+		return nil
+	}
 	if err := s.Validate(); err != nil {
 		return err
 	}
@@ -126,14 +363,32 @@ func (s *EncryptDataValidator) Bind(c *gin.Context) error {
 	return nil
 }
 
+func (s *EncryptDataValidator) isBatch() bool {
+	return len(s.BatchInput) > 0
+}
+
 func (s *EncryptDataValidator) Validate() error {
 	l, _ := common.GetLogger()
 	l.Debug("EncryptDataValidator.Validate - start")
 	s.aesPayload.Plaintext = s.Plaintext
+	s.aesPayload.Context = s.Context
+	s.aesPayload.AssociatedData = s.AssociatedData
+
+	keyVersion, err := parseKeyVersion(s.KeyVersion.Value)
+	if err != nil {
+		return err
+	}
+	s.aesPayload.KeyVersion = keyVersion
 
 	if err := s.aesPayload.validatePlaintext(); err != nil {
 		return err
 	}
+	if err := s.aesPayload.validateContext(); err != nil {
+		return err
+	}
+	if err := s.aesPayload.validateAssociatedData(); err != nil {
+		return err
+	}
 
 	l.Debug("EncryptDataValidator.Validate - end")
 	return nil
@@ -142,6 +397,11 @@ func (s *EncryptDataValidator) Validate() error {
 func NewEncryptDataValidatorFillWith(aesPayload AESPayload) EncryptDataValidator {
 	encryptDataValidator := NewEncryptDataValidator()
 	encryptDataValidator.Plaintext = aesPayload.Plaintext
+	encryptDataValidator.Context = aesPayload.Context
+	encryptDataValidator.AssociatedData = aesPayload.AssociatedData
+	if aesPayload.KeyVersion != 0 {
+		encryptDataValidator.KeyVersion = common.OptionalField{Value: fmt.Sprint(aesPayload.KeyVersion), Set: true}
+	}
 	return encryptDataValidator
 }
 
@@ -155,23 +415,457 @@ func (s *DecryptDataValidator) Bind(c *gin.Context) error {
 		return err
 	}
 
-	if s.Ciphertext == "" {
-		return errors.New("ciphertext should be specified")
+	keyVersion, err := parseKeyVersion(s.KeyVersion.Value)
+	if err != nil {
+		return err
+	}
+
+	// Errors of the batch items are reported per item
+	if s.isBatch() {
+		for _, item := range s.BatchInput {
+			aesPayload, err := parseCiphertext(item.Ciphertext, item.Context, item.AssociatedData)
+			aesPayload.KeyVersion = keyVersion
+			s.batchItems = append(s.batchItems, BatchItem{
+				AESPayload: aesPayload,
+				Reference:  item.Reference,
+				Error:      err,
+			})
+		}
+		return nil
+	}
+
+	s.aesPayload, err = parseCiphertext(s.Ciphertext, s.Context, s.AssociatedData)
+	s.aesPayload.KeyVersion = keyVersion
+	return err
+}
+
+func (s *DecryptDataValidator) isBatch() bool {
+	return len(s.BatchInput) > 0
+}
+
+func parseCiphertext(ciphertext string, context string, associatedData string) (AESPayload, error) {
+	var aesPayload AESPayload
+	if ciphertext == "" {
+		return aesPayload, errors.New("ciphertext should be specified")
+	}
+
+	version, payload, err := parseVersionedValue(ciphertext)
+	if err != nil {
+		return aesPayload, fmt.Errorf("wrong format of the ciphertext: %w", err)
+	}
+
+	aesPayload.Pref = "vault"
+	aesPayload.Version = version
+	aesPayload.Payload = payload
+	aesPayload.Context = context
+	aesPayload.AssociatedData = associatedData
+
+	if err := aesPayload.validateCiphertext(); err != nil {
+		return aesPayload, err
+	}
+	if err := aesPayload.validateContext(); err != nil {
+		return aesPayload, err
+	}
+	if err := aesPayload.validateAssociatedData(); err != nil {
+		return aesPayload, err
+	}
+
+	return aesPayload, nil
+}
+
+func NewSignDataValidator() SignDataValidator {
+	return SignDataValidator{}
+}
+
+// Hash algorithm specified in the URL takes precedence over the one from the body
+func (s *SignDataValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	if urlAlgorithm := c.Param("hash_algorithm"); urlAlgorithm != "" {
+		s.HashAlgorithm = urlAlgorithm
+	}
+
+	hashAlgorithm, err := getHashAlgorithm(s.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	s.signPayload.Input = s.Input
+	s.signPayload.HashAlgorithm = hashAlgorithm
+	s.signPayload.SignatureAlgorithm = s.SignatureAlgorithm
+	s.signPayload.Prehashed = common.ParseBool(s.Prehashed, false)
+	s.signPayload.Version, err = parseKeyVersion(s.KeyVersion.Value)
+	if err != nil {
+		return err
+	}
+
+	if err := s.signPayload.validateInput(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func NewVerifyDataValidator() VerifyDataValidator {
+	return VerifyDataValidator{}
+}
+
+// Hash algorithm specified in the URL takes precedence over the one from the body
+func (s *VerifyDataValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	if urlAlgorithm := c.Param("hash_algorithm"); urlAlgorithm != "" {
+		s.HashAlgorithm = urlAlgorithm
+	}
+
+	if s.Signature == "" && s.HMAC == "" {
+		return errors.New("signature or hmac should be specified")
+	}
+	if s.Signature != "" && s.HMAC != "" {
+		return errors.New("only one of signature or hmac should be specified")
+	}
+
+	hashAlgorithm, err := getHashAlgorithm(s.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	value := s.Signature
+	if s.HMAC != "" {
+		s.isHMAC = true
+		value = s.HMAC
+	}
+
+	version, payload, err := parseVersionedValue(value)
+	if err != nil {
+		return fmt.Errorf("wrong format of the signature: %w", err)
+	}
+	s.signature, err = base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return errors.New("signature should be b64 encoded")
+	}
+
+	s.signPayload.Input = s.Input
+	s.signPayload.HashAlgorithm = hashAlgorithm
+	s.signPayload.SignatureAlgorithm = s.SignatureAlgorithm
+	s.signPayload.Prehashed = common.ParseBool(s.Prehashed, false)
+	s.signPayload.Version = version
+
+	if err := s.signPayload.validateInput(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func NewHMACDataValidator() HMACDataValidator {
+	return HMACDataValidator{}
+}
+
+// Algorithm specified in the URL takes precedence over the one from the body
+func (s *HMACDataValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	if urlAlgorithm := c.Param("algorithm"); urlAlgorithm != "" {
+		s.Algorithm = urlAlgorithm
+	}
+
+	hashAlgorithm, err := getHashAlgorithm(s.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	if s.Input == "" {
+		return errors.New("input should be specified")
+	}
+
+	s.hmacPayload.Input = s.Input
+	s.hmacPayload.HashAlgorithm = hashAlgorithm
+	s.hmacPayload.Version, err = parseKeyVersion(s.KeyVersion.Value)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func NewHashDataValidator() HashDataValidator {
+	return HashDataValidator{}
+}
+
+// Algorithm specified in the URL takes precedence over the one from the body
+func (s *HashDataValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	if urlAlgorithm := c.Param("algorithm"); urlAlgorithm != "" {
+		s.Algorithm = urlAlgorithm
+	}
+
+	hashAlgorithm, err := getHashAlgorithm(s.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	if s.Input == "" {
+		return errors.New("input should be specified")
+	}
+
+	s.hashPayload.Input = s.Input
+	s.hashPayload.HashAlgorithm = hashAlgorithm
+	s.hashPayload.Format = s.Format
+
+	return nil
+}
+
+func NewKeyTrimValidatorFillWith(keyModel KeyModel) KeyTrimValidator {
+	return KeyTrimValidator{keyModel: keyModel}
+}
+
+// Trimmed versions can't be restored, so min available version can only move forward
+// and can't go above the versions which are still allowed to be used
+func (s *KeyTrimValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+
+	minAvailableVersion := common.ParseInt(s.MinAvailableVersion, 0)
+	if minAvailableVersion < 1 {
+		return errors.New("min_available_version should be specified and be greater than 0")
+	}
+	if minAvailableVersion < s.keyModel.MinAvailableVersion {
+		return fmt.Errorf("min_available_version can't be lower than the current min available version v%d", s.keyModel.MinAvailableVersion)
+	}
+	if minAvailableVersion > s.keyModel.MinDecryptionVersion {
+		return fmt.Errorf("min_available_version can't be higher than min_decryption_version v%d", s.keyModel.MinDecryptionVersion)
+	}
+	if minAvailableVersion > s.keyModel.MinEncryptionVersion {
+		return fmt.Errorf("min_available_version can't be higher than min_encryption_version v%d", s.keyModel.MinEncryptionVersion)
+	}
+
+	s.minAvailableVersion = minAvailableVersion
+	return nil
+}
+
+func NewKeyCacheConfigValidator() KeyCacheConfigValidator {
+	return KeyCacheConfigValidator{}
+}
+
+// Size is 0 by default, the same as in Vault
+func (s *KeyCacheConfigValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if !s.Size.Set {
+		return nil
+	}
+	size, err := strconv.Atoi(s.Size.Value)
+	if err != nil || size < 0 {
+		return errors.New("size should be a non-negative integer")
+	}
+	if size != 0 && size < MIN_KEY_CACHE_SIZE {
+		return fmt.Errorf("size must be 0 or a value greater or equal to %d", MIN_KEY_CACHE_SIZE)
+	}
+	s.size = size
+	return nil
+}
+
+func NewDataKeyValidator() DataKeyValidator {
+	return DataKeyValidator{}
+}
+
+// Body is optional for the data keys, so the empty body isn't an error
+func (s *DataKeyValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	switch c.Param("type") {
+	case DATAKEY_TYPE_PLAINTEXT:
+		s.plaintext = true
+	case DATAKEY_TYPE_WRAPPED:
+		s.plaintext = false
+	default:
+		return fmt.Errorf("type should be %q or %q", DATAKEY_TYPE_PLAINTEXT, DATAKEY_TYPE_WRAPPED)
+	}
+
+	bits := DEFAULT_DATAKEY_BITS
+	if s.Bits.Value != "" {
+		bits = common.ParseInt(s.Bits.Value, 0)
+	}
+	if bits != 128 && bits != 256 && bits != 512 {
+		return errors.New("bits should be 128, 256 or 512")
+	}
+
+	s.aesPayload.Plaintext, err = generateDataKey(bits)
+	if err != nil {
+		return err
+	}
+	s.aesPayload.Context = s.Context
+	s.aesPayload.AssociatedData = s.AssociatedData
+	if err := s.aesPayload.validateContext(); err != nil {
+		return err
+	}
+	return s.aesPayload.validateAssociatedData()
+}
+
+func NewKeyImportValidator() KeyImportValidator {
+	return KeyImportValidator{}
+}
+
+// Parse the wrapped key material, the key material itself is unwrapped and validated later
+func parseWrappedKeyMaterial(ciphertext string, hashFunction string) ([]byte, error) {
+	if ciphertext == "" {
+		return nil, errors.New("ciphertext should be specified")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, errors.New("ciphertext should be b64 encoded")
+	}
+	hash, err := getImportHashFunction(hashFunction)
+	if err != nil {
+		return nil, err
 	}
+	return unwrapKeyMaterial(wrapped, hash)
+}
 
-	data := strings.Split(s.Ciphertext, ":")
+func (s *KeyImportValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
 
-	if len(data) != 3 {
-		return errors.New("Wrong format of the ciphertext is recieved")
+	keyType := s.Type
+	if keyType == "" {
+		keyType = KEY_TYPE_AES256_GCM96
+	}
+	if !keyType.IsValid() {
+		return fmt.Errorf("unknown key type %q", keyType)
+	}
+	derived := common.ParseBool(s.Derived.Value, false)
+	if derived && !keyType.SupportsDerivation() {
+		return fmt.Errorf("key derivation isn't supported by the %s keys", keyType)
+	}
+	allowRotation := common.ParseBool(s.AllowRotation.Value, false)
+	autoRotatePeriod, err := common.ParseDurationSeconds(s.AutoRotatePeriod)
+	if err != nil {
+		return fmt.Errorf("invalid auto_rotate_period: %w", err)
+	}
+	if autoRotatePeriod != 0 && autoRotatePeriod < MIN_AUTO_ROTATE_PERIOD {
+		return errors.New("auto_rotate_period should be 0 to disable rotation, or at least 1h")
+	}
+	if autoRotatePeriod != 0 && !allowRotation {
+		return errors.New("allow_rotation should be enabled to set auto_rotate_period")
 	}
 
-	s.aesPayload.Pref = data[0]
-	s.aesPayload.Version = common.ParseInt(string(data[1][1]), 1)
-	s.aesPayload.Payload = data[2]
+	s.material, err = parseWrappedKeyMaterial(s.Ciphertext, s.HashFunction)
+	if err != nil {
+		return err
+	}
+	key, err := importKeyVersion(keyType, s.material, 1)
+	if err != nil {
+		return err
+	}
+
+	s.keyModel = KeyModel{
+		Name:                     s.Name,
+		Type:                     keyType,
+		Keys:                     []AESKeyModel{key},
+		AllowPlaintextBackup:     common.ParseBool(s.AllowPlaintextBackup.Value, false),
+		AutoRotatePeriod:         autoRotatePeriod,
+		DeletionAllowed:          common.ParseBool(s.DeletionAllowed.Value, false),
+		Derived:                  derived,
+		Exportable:               common.ParseBool(s.Exportable.Value, false),
+		ImportedKey:              true,
+		AllowImportedKeyRotation: allowRotation,
+		LatestVersion:            1,
+		MinAvailableVersion:      1,
+		MinDecryptionVersion:     1,
+		MinEncryptionVersion:     1,
+		SupportsDecryption:       keyType.SupportsEncryption(),
+		SupportsEncryption:       keyType.SupportsEncryption(),
+		SupportsSigning:          keyType.SupportsSigning(),
+		SupportsDerivation:       keyType.SupportsDerivation(),
+	}
+	return nil
+}
 
-	if err := s.aesPayload.validateCiphertext(); err != nil {
+func NewKeyImportVersionValidatorFillWith(keyModel KeyModel) KeyImportVersionValidator {
+	return KeyImportVersionValidator{keyModel: keyModel}
+}
+
+// New version of the key is created with the imported key material, only the imported keys could get new versions this way
+func (s *KeyImportVersionValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
 		return err
 	}
+	if !s.keyModel.ImportedKey {
+		return errors.New("new versions could be imported only to the imported keys")
+	}
 
+	s.material, err = parseWrappedKeyMaterial(s.Ciphertext, s.HashFunction)
+	if err != nil {
+		return err
+	}
+	key, err := importKeyVersion(s.keyModel.Type, s.material, s.keyModel.LatestVersion+1)
+	if err != nil {
+		return err
+	}
+	s.keyModel.Keys = append(s.keyModel.Keys, key)
+	s.keyModel.LatestVersion = key.Version
 	return nil
 }
+
+func NewKeyRestoreValidator() KeyRestoreValidator {
+	return KeyRestoreValidator{}
+}
+
+// Name from the URL takes precedence over the name in the body and the name saved in the backup
+func (s *KeyRestoreValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	if s.Backup == "" {
+		return errors.New("backup should be specified")
+	}
+
+	s.keyModel, err = restoreKey(s.Backup)
+	if err != nil {
+		return err
+	}
+	if name := c.Param("name"); name != "" {
+		s.Name = name
+	}
+	if s.Name != "" {
+		s.keyModel.Name = s.Name
+	}
+	if s.keyModel.Name == "" {
+		return errors.New("name should be specified")
+	}
+	s.force = common.ParseBool(s.Force.Value, false)
+	return nil
+}
+
+// Parse the requested key version, 0 means the latest version
+func parseKeyVersion(str string) (int, error) {
+	if str == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(str)
+	if err != nil || version < 0 {
+		return 0, errors.New("key_version should be a positive integer")
+	}
+	return version, nil
+}
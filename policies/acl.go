@@ -0,0 +1,355 @@
+package policies
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Path rules of the policies grouped in the same way as Vault does it for matching
+// Prefix rules are stored without the trailing '*', segment wildcard rules keep it
+type ACL struct {
+	root                 bool
+	exactRules           map[string]*ACLPermissions
+	prefixRules          map[string]*ACLPermissions
+	segmentWildcardPaths map[string]*ACLPermissions
+}
+
+// Candidate for the non exact match, used to pick the rule with the highest priority
+type wildcardMatch struct {
+	firstWildcardOrGlob int
+	path                string
+	isPrefix            bool
+	wildcards           int
+	permissions         *ACLPermissions
+}
+
+// Build the ACL from the policies attached to the token
+// Rules of the same path defined by several policies are merged, deny always wins
+func NewACL(hclPolicies []HCLPolicy) *ACL {
+	acl := &ACL{
+		exactRules:           map[string]*ACLPermissions{},
+		prefixRules:          map[string]*ACLPermissions{},
+		segmentWildcardPaths: map[string]*ACLPermissions{},
+	}
+	for _, hclPolicy := range hclPolicies {
+		if hclPolicy.Name == "root" {
+			acl.root = true
+		}
+		for _, pc := range hclPolicy.Paths {
+			rules := acl.exactRules
+			switch {
+			case pc.HasSegmentWildcards:
+				rules = acl.segmentWildcardPaths
+			case pc.IsPrefix:
+				rules = acl.prefixRules
+			}
+			existing, ok := rules[pc.Path]
+			if !ok {
+				existing = &ACLPermissions{}
+				rules[pc.Path] = existing
+			}
+			existing.merge(pc.Permissions)
+		}
+	}
+	return acl
+}
+
+// Merge permissions of the same path from another policy in the same way as Vault does it
+// Deny clears all the other capabilities and parameters, empty list of the allowed values allows any value
+func (p *ACLPermissions) merge(other *ACLPermissions) {
+	if p.CapabilitiesBitmap&DenyCapabilityInt > 0 {
+		return
+	}
+	if other.CapabilitiesBitmap&DenyCapabilityInt > 0 {
+		*p = ACLPermissions{CapabilitiesBitmap: DenyCapabilityInt}
+		return
+	}
+	p.CapabilitiesBitmap |= other.CapabilitiesBitmap
+	p.AllowedParameters = mergeParameters(p.AllowedParameters, other.AllowedParameters)
+	p.DeniedParameters = mergeParameters(p.DeniedParameters, other.DeniedParameters)
+	for _, param := range other.RequiredParameters {
+		if !containsString(p.RequiredParameters, param) {
+			p.RequiredParameters = append(p.RequiredParameters, param)
+		}
+	}
+}
+
+func mergeParameters(params map[string][]interface{}, other map[string][]interface{}) map[string][]interface{} {
+	if len(other) == 0 {
+		return params
+	}
+	if params == nil {
+		params = map[string][]interface{}{}
+	}
+	for key, values := range other {
+		existing, ok := params[key]
+		if len(values) == 0 || (ok && len(existing) == 0) {
+			params[key] = []interface{}{}
+			continue
+		}
+		params[key] = append(append([]interface{}{}, existing...), values...)
+	}
+	return params
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Order of the capabilities in the Vault capabilities responses
+var capabilitiesOrder = []string{SudoCapability, ReadCapability, ListCapability, UpdateCapability, DeleteCapability, CreateCapability, PatchCapability}
+
+// Check if the root policy is attached, everything is granted to the root
+func (a *ACL) IsRoot() bool {
+	return a.root
+}
+
+// Check if the capability is granted on the path, nothing is granted on the denied paths
+// List capability is also granted by the exact rule of the path without the trailing '/'
+func (a *ACL) HasCapability(path string, capability string) bool {
+	if a.root {
+		return true
+	}
+	permissions := a.MatchPath(path, capability == ListCapability)
+	if permissions == nil || permissions.CapabilitiesBitmap&DenyCapabilityInt > 0 {
+		return false
+	}
+	return permissions.CapabilitiesBitmap&cap2Int[capability] > 0
+}
+
+// List of the capabilities granted on the path in the same way as Vault reports them
+// Root policy is reported as root, denied or not matched paths are reported as deny
+func (a *ACL) Capabilities(path string) []string {
+	if a.root {
+		return []string{RootCapability}
+	}
+	granted := map[string]bool{}
+	if permissions := a.MatchPath(path, false); permissions != nil && permissions.CapabilitiesBitmap&DenyCapabilityInt == 0 {
+		granted = GetCapabilitiesFromBitmap(permissions.CapabilitiesBitmap)
+	}
+	// Exact rule without the trailing '/' grants only the list capability, the same as for the list requests
+	granted[ListCapability] = a.HasCapability(path, ListCapability)
+
+	capabilities := []string{}
+	for _, capability := range capabilitiesOrder {
+		if granted[capability] {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if len(capabilities) == 0 {
+		return []string{DenyCapability}
+	}
+	return capabilities
+}
+
+// Check the request parameters against the allowed, denied and required parameters of the path
+func (a *ACL) CheckParameters(path string, data map[string]interface{}) error {
+	permissions := a.MatchPath(path, false)
+	if permissions == nil {
+		return nil
+	}
+	return permissions.checkParameters(data)
+}
+
+// Check if the rule matching the path restricts the request parameters,
+// parameters don't need to be read from the request otherwise
+func (a *ACL) HasParameterConstraints(path string) bool {
+	permissions := a.MatchPath(path, false)
+	if permissions == nil {
+		return false
+	}
+	return len(permissions.AllowedParameters) > 0 || len(permissions.DeniedParameters) > 0 || len(permissions.RequiredParameters) > 0
+}
+
+// Check the request parameters in the same way as Vault does it
+// Denied parameters are checked first, '*' denies or allows any parameter, empty list of values matches any value
+func (p *ACLPermissions) checkParameters(data map[string]interface{}) error {
+	params := map[string]interface{}{}
+	names := []string{}
+	for name, value := range data {
+		params[strings.ToLower(name)] = value
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	for _, name := range p.RequiredParameters {
+		if _, ok := params[name]; !ok {
+			return fmt.Errorf("missing required parameter %q", name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	if _, ok := p.DeniedParameters["*"]; ok {
+		return fmt.Errorf("parameter %q is denied", names[0])
+	}
+	for _, name := range names {
+		if values, ok := p.DeniedParameters[name]; ok && valueInParameterList(params[name], values) {
+			return fmt.Errorf("parameter %q is denied", name)
+		}
+	}
+
+	if len(p.AllowedParameters) == 0 {
+		return nil
+	}
+	_, allowedAll := p.AllowedParameters["*"]
+	for _, name := range names {
+		values, ok := p.AllowedParameters[name]
+		if !ok && !allowedAll {
+			return fmt.Errorf("parameter %q is not allowed", name)
+		}
+		if ok && !valueInParameterList(params[name], values) {
+			return fmt.Errorf("value of the parameter %q is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// Empty list of values matches any value
+func valueInParameterList(value interface{}, list []interface{}) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if parameterValueMatches(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// String values are matched with the '*' glob at the start or end of the policy value
+// Other values are compared by their text form, so "1" from the request matches 1 from the policy
+func parameterValueMatches(item interface{}, value interface{}) bool {
+	if item == nil || value == nil {
+		return item == value
+	}
+	pattern, isString := item.(string)
+	str, ok := value.(string)
+	if !isString || !ok {
+		return fmt.Sprint(item) == fmt.Sprint(value)
+	}
+	switch {
+	case len(pattern) < 2:
+	case strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*"):
+		return strings.Contains(str, pattern[1:len(pattern)-1])
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(str, pattern[1:])
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(str, pattern[:len(pattern)-1])
+	}
+	return pattern == str
+}
+
+// Find the permissions of the rule matching the path
+// Exact match is used first, then the longest prefix and the segment wildcards with the Vault priority rules
+// List requests are also matching the exact rule without the trailing '/'
+func (a *ACL) MatchPath(path string, list bool) *ACLPermissions {
+	if permissions, ok := a.exactRules[path]; ok {
+		return permissions
+	}
+	if list {
+		if permissions, ok := a.exactRules[strings.TrimSuffix(path, "/")]; ok {
+			return permissions
+		}
+	}
+	return a.matchNonExactPath(path)
+}
+
+// Find the longest prefix rule matching the path
+func (a *ACL) longestPrefix(path string) (string, *ACLPermissions, bool) {
+	longest := ""
+	var permissions *ACLPermissions
+	found := false
+	for prefix, p := range a.prefixRules {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(longest)) {
+			longest, permissions, found = prefix, p, true
+		}
+	}
+	return longest, permissions, found
+}
+
+func (a *ACL) matchNonExactPath(path string) *ACLPermissions {
+	prefix, permissions, found := a.longestPrefix(path)
+	if len(a.segmentWildcardPaths) == 0 {
+		return permissions
+	}
+
+	matches := []wildcardMatch{}
+	pathParts := strings.Split(path, "/")
+	for fullPath, p := range a.segmentWildcardPaths {
+		if match, ok := matchSegmentWildcardPath(fullPath, pathParts); ok {
+			match.permissions = p
+			matches = append(matches, match)
+		}
+	}
+	if found {
+		matches = append(matches, wildcardMatch{
+			firstWildcardOrGlob: len(prefix),
+			path:                prefix,
+			isPrefix:            true,
+			permissions:         permissions,
+		})
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].higherPriority(matches[j])
+	})
+	return matches[0].permissions
+}
+
+// Check if the segment wildcard path matches the request path split by '/'
+// '+' matches any single segment, the trailing '*' matches the rest of the path
+func matchSegmentWildcardPath(fullPath string, pathParts []string) (wildcardMatch, bool) {
+	match := wildcardMatch{firstWildcardOrGlob: strings.Index(fullPath, "+")}
+	wcPath := fullPath
+	if strings.HasSuffix(wcPath, "*") {
+		match.isPrefix = true
+		wcPath = strings.TrimSuffix(wcPath, "*")
+	}
+	match.path = wcPath
+
+	wcParts := strings.Split(wcPath, "/")
+	if len(pathParts) < len(wcParts) || (!match.isPrefix && len(pathParts) != len(wcParts)) {
+		return match, false
+	}
+	for i, part := range wcParts {
+		switch {
+		case part == "+":
+			match.wildcards++
+		case part == pathParts[i]:
+		case match.isPrefix && i == len(wcParts)-1 && strings.HasPrefix(pathParts[i], part):
+		default:
+			return match, false
+		}
+	}
+	return match, true
+}
+
+// Priority rules of Vault for the non exact matches:
+// the first wildcard or glob is later, no trailing glob, fewer '+' segments, longer path, lexicographically larger path
+func (m wildcardMatch) higherPriority(other wildcardMatch) bool {
+	if m.firstWildcardOrGlob != other.firstWildcardOrGlob {
+		return m.firstWildcardOrGlob > other.firstWildcardOrGlob
+	}
+	if m.isPrefix != other.isPrefix {
+		return !m.isPrefix
+	}
+	if m.wildcards != other.wildcards {
+		return m.wildcards < other.wildcards
+	}
+	if len(m.path) != len(other.path) {
+		return len(m.path) > len(other.path)
+	}
+	return m.path > other.path
+}
@@ -0,0 +1,435 @@
+package policies
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "vau-policies")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_DB_PATH), dir)
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_LOG_LEVEL), "error")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+const unsealPolicy = `
+path "transit/encrypt/*" {
+  capabilities = ["update"]
+}
+
+path "transit/decrypt/unseal-key" {
+  capabilities = ["update"]
+}
+
+path "transit/+/unseal-key" {
+  capabilities = ["read"]
+}
+
+path "transit/keys" {
+  capabilities = ["list"]
+}
+
+path "transit/keys/unseal-*" {
+  capabilities = ["read", "create", "update"]
+}
+
+path "transit/keys/unseal-key/config" {
+  capabilities = ["deny"]
+}
+`
+
+// Fixture of the segment wildcard priority rules from the Vault documentation
+const priorityPolicy = `
+path "secret/*" {
+  capabilities = ["read"]
+}
+
+path "secret/+/foo" {
+  capabilities = ["create"]
+}
+
+path "secret/+/+/foo" {
+  capabilities = ["update"]
+}
+
+path "secret/bar/+/foo" {
+  capabilities = ["delete"]
+}
+
+path "secret/bar/*" {
+  capabilities = ["list"]
+}
+
+path "secret/+/ba*" {
+  capabilities = ["sudo"]
+}
+
+path "secret/+/baz" {
+  capabilities = ["patch"]
+}
+
+path "+/zip/*" {
+  capabilities = ["deny"]
+}
+`
+
+func rootPolicyText(t *testing.T) string {
+	text, err := common.DecFromB64(NewRootPolicy().Text)
+	require.NoError(t, err)
+	return text
+}
+
+func newTestACL(t *testing.T, texts ...string) *ACL {
+	hclPolicies := []HCLPolicy{}
+	for _, text := range texts {
+		hclPolicy, err := ParseHCLPolicy(text)
+		require.NoError(t, err)
+		hclPolicies = append(hclPolicies, *hclPolicy)
+	}
+	return NewACL(hclPolicies)
+}
+
+func TestACL_MatchPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		path   string
+		list   bool
+		bitmap uint32
+	}{
+		{name: "prefix", policy: unsealPolicy, path: "transit/encrypt/unseal-key", bitmap: UpdateCapabilityInt},
+		{name: "prefix of any depth", policy: unsealPolicy, path: "transit/encrypt/a/b", bitmap: UpdateCapabilityInt},
+		{name: "exact over wildcard", policy: unsealPolicy, path: "transit/decrypt/unseal-key", bitmap: UpdateCapabilityInt},
+		{name: "segment wildcard", policy: unsealPolicy, path: "transit/rewrap/unseal-key", bitmap: ReadCapabilityInt},
+		{name: "prefix over segment wildcard", policy: unsealPolicy, path: "transit/encrypt/unseal-key", bitmap: UpdateCapabilityInt},
+		{name: "segment wildcard doesn't match deeper paths", policy: unsealPolicy, path: "transit/rewrap/unseal-key/1"},
+		{name: "segment wildcard doesn't match other segments", policy: unsealPolicy, path: "transit/rewrap/other-key"},
+		{name: "glob inside the segment", policy: unsealPolicy, path: "transit/keys/unseal-other", bitmap: ReadCapabilityInt | CreateCapabilityInt | UpdateCapabilityInt},
+		{name: "exact deny", policy: unsealPolicy, path: "transit/keys/unseal-key/config", bitmap: DenyCapabilityInt},
+		{name: "prefix next to exact deny", policy: unsealPolicy, path: "transit/keys/unseal-key/rotate", bitmap: ReadCapabilityInt | CreateCapabilityInt | UpdateCapabilityInt},
+		{name: "list with trailing slash", policy: unsealPolicy, path: "transit/keys/", list: true, bitmap: ListCapabilityInt},
+		{name: "trailing slash without list", policy: unsealPolicy, path: "transit/keys/"},
+		{name: "no match", policy: unsealPolicy, path: "sys/policy/default"},
+		{name: "root", policy: rootPolicyText(t), path: "transit/keys/any", bitmap: ReadCapabilityInt | CreateCapabilityInt | ListCapabilityInt | UpdateCapabilityInt | DeleteCapabilityInt | SudoCapabilityInt},
+
+		{name: "later wildcard wins", policy: priorityPolicy, path: "secret/bar/zap/foo", bitmap: DeleteCapabilityInt},
+		{name: "later wildcard than the glob", policy: priorityPolicy, path: "secret/zip/zap/foo", bitmap: UpdateCapabilityInt},
+		{name: "no trailing glob wins", policy: priorityPolicy, path: "secret/zap/baz", bitmap: PatchCapabilityInt},
+		{name: "fewer wildcards win", policy: priorityPolicy, path: "secret/zap/bat", bitmap: ReadCapabilityInt},
+		{name: "later glob wins", policy: priorityPolicy, path: "secret/bar/bat", bitmap: ListCapabilityInt},
+		{name: "longer prefix wins", policy: priorityPolicy, path: "secret/bar/zap", bitmap: ListCapabilityInt},
+		{name: "single segment wildcard", policy: priorityPolicy, path: "secret/zap/foo", bitmap: CreateCapabilityInt},
+		{name: "shorter prefix", policy: priorityPolicy, path: "secret/zap", bitmap: ReadCapabilityInt},
+		{name: "leading segment wildcard", policy: priorityPolicy, path: "kv/zip/zap", bitmap: DenyCapabilityInt},
+		{name: "leading segment wildcard loses to the later wildcard", policy: priorityPolicy, path: "secret/zip/foo", bitmap: CreateCapabilityInt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			permissions := newTestACL(t, tt.policy).MatchPath(tt.path, tt.list)
+			if tt.bitmap == 0 {
+				require.Nil(t, permissions)
+				return
+			}
+			require.NotNil(t, permissions)
+			require.Equal(t, tt.bitmap, permissions.CapabilitiesBitmap)
+		})
+	}
+}
+
+func TestMatchSegmentWildcardPath(t *testing.T) {
+	tests := []struct {
+		wcPath    string
+		path      string
+		match     bool
+		wildcards int
+	}{
+		{wcPath: "+", path: "secret", match: true, wildcards: 1},
+		{wcPath: "+", path: "secret/foo"},
+		{wcPath: "+/foo", path: "secret/foo", match: true, wildcards: 1},
+		{wcPath: "+/+/foo", path: "secret/bar/foo", match: true, wildcards: 2},
+		{wcPath: "secret/+/foo*", path: "secret/bar/foobar/baz", match: true, wildcards: 1},
+		{wcPath: "secret/+/*", path: "secret/bar/", match: true, wildcards: 1},
+		{wcPath: "secret/+/*", path: "secret/bar/baz/foo", match: true, wildcards: 1},
+		{wcPath: "secret/+/*", path: "secret/bar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wcPath+" "+tt.path, func(t *testing.T) {
+			match, ok := matchSegmentWildcardPath(tt.wcPath, strings.Split(tt.path, "/"))
+			require.Equal(t, tt.match, ok)
+			if ok {
+				require.Equal(t, tt.wildcards, match.wildcards)
+			}
+		})
+	}
+}
+
+const encryptPolicy = `
+path "transit/encrypt/unseal-key" {
+  capabilities = ["update"]
+}
+
+path "transit/keys/*" {
+  capabilities = ["read"]
+}
+`
+
+const decryptPolicy = `
+path "transit/encrypt/unseal-key" {
+  capabilities = ["read"]
+}
+
+path "transit/decrypt/unseal-key" {
+  capabilities = ["update"]
+}
+`
+
+const denyPolicy = `
+path "transit/encrypt/unseal-key" {
+  capabilities = ["deny"]
+}
+`
+
+func TestACL_HasCapability(t *testing.T) {
+	tests := []struct {
+		name       string
+		policies   []string
+		path       string
+		capability string
+		allowed    bool
+	}{
+		{name: "first policy", policies: []string{encryptPolicy, decryptPolicy}, path: "transit/encrypt/unseal-key", capability: UpdateCapability, allowed: true},
+		{name: "merged from the second policy", policies: []string{encryptPolicy, decryptPolicy}, path: "transit/encrypt/unseal-key", capability: ReadCapability, allowed: true},
+		{name: "path of the second policy", policies: []string{encryptPolicy, decryptPolicy}, path: "transit/decrypt/unseal-key", capability: UpdateCapability, allowed: true},
+		{name: "not granted by any policy", policies: []string{encryptPolicy, decryptPolicy}, path: "transit/encrypt/unseal-key", capability: DeleteCapability},
+		{name: "deny in the second policy", policies: []string{encryptPolicy, denyPolicy}, path: "transit/encrypt/unseal-key", capability: UpdateCapability},
+		{name: "deny in the first policy", policies: []string{denyPolicy, encryptPolicy, decryptPolicy}, path: "transit/encrypt/unseal-key", capability: ReadCapability},
+		{name: "deny doesn't affect other paths", policies: []string{encryptPolicy, denyPolicy}, path: "transit/keys/unseal-key", capability: ReadCapability, allowed: true},
+		{name: "list", policies: []string{unsealPolicy}, path: "transit/keys", capability: ListCapability, allowed: true},
+		{name: "deny capability isn't granted", policies: []string{denyPolicy}, path: "transit/encrypt/unseal-key", capability: DenyCapability},
+		{name: "no policies", path: "transit/encrypt/unseal-key", capability: UpdateCapability},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := newTestACL(t, tt.policies...)
+			require.Equal(t, tt.allowed, acl.HasCapability(tt.path, tt.capability))
+		})
+	}
+}
+
+const listPolicy = `
+path "transit/keys" {
+  capabilities = ["read", "update", "list"]
+}
+
+path "transit/*" {
+  capabilities = ["deny"]
+}
+`
+
+func TestACL_Capabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		policies     []string
+		path         string
+		capabilities []string
+	}{
+		{name: "merged policies", policies: []string{encryptPolicy, decryptPolicy}, path: "transit/encrypt/unseal-key", capabilities: []string{ReadCapability, UpdateCapability}},
+		{name: "vault order", policies: []string{unsealPolicy}, path: "transit/keys/unseal-key", capabilities: []string{ReadCapability, UpdateCapability, CreateCapability}},
+		{name: "segment wildcard", policies: []string{priorityPolicy}, path: "secret/foo/baz", capabilities: []string{PatchCapability}},
+		{name: "list without the trailing slash", policies: []string{unsealPolicy}, path: "transit/keys/", capabilities: []string{ListCapability}},
+		{name: "only list from the rule without the trailing slash", policies: []string{listPolicy}, path: "transit/keys/", capabilities: []string{ListCapability}},
+		{name: "exact rule", policies: []string{listPolicy}, path: "transit/keys", capabilities: []string{ReadCapability, ListCapability, UpdateCapability}},
+		{name: "denied path", policies: []string{unsealPolicy}, path: "transit/keys/unseal-key/config", capabilities: []string{DenyCapability}},
+		{name: "deny in the second policy", policies: []string{encryptPolicy, denyPolicy}, path: "transit/encrypt/unseal-key", capabilities: []string{DenyCapability}},
+		{name: "not matched", policies: []string{unsealPolicy}, path: "sys/policy/default", capabilities: []string{DenyCapability}},
+		{name: "no policies", path: "transit/encrypt/unseal-key", capabilities: []string{DenyCapability}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := newTestACL(t, tt.policies...)
+			require.Equal(t, tt.capabilities, acl.Capabilities(tt.path))
+		})
+	}
+}
+
+func TestACL_Root(t *testing.T) {
+	acl := NewACL([]HCLPolicy{{Name: "root"}})
+	require.True(t, acl.IsRoot())
+	require.True(t, acl.HasCapability("sys/seal", SudoCapability))
+	require.Equal(t, []string{RootCapability}, acl.Capabilities("transit/keys/unseal-key"))
+
+	acl = newTestACL(t, rootPolicyText(t))
+	require.False(t, acl.IsRoot())
+}
+
+func TestACLPermissions_merge(t *testing.T) {
+	permissions := &ACLPermissions{}
+	permissions.merge(&ACLPermissions{
+		CapabilitiesBitmap: UpdateCapabilityInt,
+		AllowedParameters:  map[string][]interface{}{"plaintext": {}, "context": {"a"}},
+		RequiredParameters: []string{"plaintext"},
+	})
+	permissions.merge(&ACLPermissions{
+		CapabilitiesBitmap: ReadCapabilityInt,
+		AllowedParameters:  map[string][]interface{}{"plaintext": {"b"}, "context": {"b"}, "key_version": {}},
+		DeniedParameters:   map[string][]interface{}{"batch_input": {}},
+		RequiredParameters: []string{"plaintext", "context"},
+	})
+	require.Equal(t, UpdateCapabilityInt|ReadCapabilityInt, permissions.CapabilitiesBitmap)
+	require.Equal(t, map[string][]interface{}{
+		"plaintext":   {},
+		"context":     {"a", "b"},
+		"key_version": {},
+	}, permissions.AllowedParameters)
+	require.Equal(t, map[string][]interface{}{"batch_input": {}}, permissions.DeniedParameters)
+	require.Equal(t, []string{"plaintext", "context"}, permissions.RequiredParameters)
+
+	permissions.merge(&ACLPermissions{CapabilitiesBitmap: DenyCapabilityInt})
+	require.Equal(t, ACLPermissions{CapabilitiesBitmap: DenyCapabilityInt}, *permissions)
+
+	permissions.merge(&ACLPermissions{CapabilitiesBitmap: UpdateCapabilityInt})
+	require.Equal(t, DenyCapabilityInt, permissions.CapabilitiesBitmap)
+}
+
+const parametersPolicy = `
+path "transit/rewrap/unseal-key" {
+  capabilities = ["update"]
+  denied_parameters = {
+    "key_version" = []
+  }
+}
+
+path "transit/encrypt/unseal-key" {
+  capabilities = ["update"]
+  allowed_parameters = {
+    "plaintext" = []
+    "Context" = ["dmF1bHQ=", "dW5zZWFs*"]
+    "key_version" = [1, 2]
+  }
+  required_parameters = ["plaintext"]
+}
+
+path "transit/keys/*" {
+  capabilities = ["create", "update"]
+  allowed_parameters = {
+    "*" = []
+    "type" = ["aes*", "*25519", "*p25*"]
+  }
+  denied_parameters = {
+    "exportable" = [true, "true"]
+  }
+}
+
+path "transit/hmac/*" {
+  capabilities = ["update"]
+  denied_parameters = {
+    "*" = []
+  }
+}
+`
+
+func TestParseHCLPolicy_Parameters(t *testing.T) {
+	hclPolicy, err := ParseHCLPolicy(parametersPolicy)
+	require.NoError(t, err)
+	require.Len(t, hclPolicy.Paths, 4)
+
+	encrypt := hclPolicy.Paths[1].Permissions
+	require.Equal(t, []string{"plaintext"}, encrypt.RequiredParameters)
+	require.Contains(t, encrypt.AllowedParameters, "context")
+	require.Len(t, encrypt.AllowedParameters["key_version"], 2)
+	require.Empty(t, encrypt.AllowedParameters["plaintext"])
+
+	rewrap := hclPolicy.Paths[0].Permissions
+	require.Contains(t, rewrap.DeniedParameters, "key_version")
+	require.Nil(t, rewrap.AllowedParameters)
+}
+
+func TestACL_CheckParameters(t *testing.T) {
+	acl := newTestACL(t, parametersPolicy)
+	tests := []struct {
+		name  string
+		path  string
+		data  map[string]interface{}
+		param string
+	}{
+		{name: "no constraints", path: "transit/decrypt/unseal-key", data: map[string]interface{}{"key_version": 1}},
+		{name: "allowed parameters", path: "transit/rewrap/unseal-key", data: map[string]interface{}{"ciphertext": "vault:v1:dGVzdA=="}},
+		{name: "denied parameter", path: "transit/rewrap/unseal-key", data: map[string]interface{}{"ciphertext": "vault:v1:dGVzdA==", "key_version": 2}, param: "key_version"},
+		{name: "denied parameter case", path: "transit/rewrap/unseal-key", data: map[string]interface{}{"Key_Version": "2"}, param: "key_version"},
+		{name: "missing required parameter", path: "transit/encrypt/unseal-key", data: map[string]interface{}{}, param: "plaintext"},
+		{name: "required parameter", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA=="}},
+		{name: "not allowed parameter", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "associated_data": "dGVzdA=="}, param: "associated_data"},
+		{name: "allowed value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "context": "dmF1bHQ="}},
+		{name: "glob value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "context": "dW5zZWFsLWtleQ=="}},
+		{name: "not allowed value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "context": "b3RoZXI="}, param: "context"},
+		{name: "number value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": float64(2)}},
+		{name: "string number value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": "1"}},
+		{name: "not allowed number value", path: "transit/encrypt/unseal-key", data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": float64(3)}, param: "key_version"},
+		{name: "wildcard allows any parameter", path: "transit/keys/unseal-key", data: map[string]interface{}{"deletion_allowed": true, "type": "aes256-gcm96"}},
+		{name: "suffix glob", path: "transit/keys/unseal-key", data: map[string]interface{}{"type": "ed25519"}},
+		{name: "contains glob", path: "transit/keys/unseal-key", data: map[string]interface{}{"type": "ecdsa-p256"}},
+		{name: "not matching glob", path: "transit/keys/unseal-key", data: map[string]interface{}{"type": "rsa-2048"}, param: "type"},
+		{name: "denied value", path: "transit/keys/unseal-key", data: map[string]interface{}{"exportable": true}, param: "exportable"},
+		{name: "denied string value", path: "transit/keys/unseal-key", data: map[string]interface{}{"exportable": "true"}, param: "exportable"},
+		{name: "not denied value", path: "transit/keys/unseal-key", data: map[string]interface{}{"exportable": false}},
+		{name: "all parameters denied", path: "transit/hmac/unseal-key", data: map[string]interface{}{"input": "dGVzdA=="}, param: "input"},
+		{name: "all parameters denied without parameters", path: "transit/hmac/unseal-key", data: map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := acl.CheckParameters(tt.path, tt.data)
+			if tt.param == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), fmt.Sprintf("%q", tt.param))
+		})
+	}
+}
+
+func TestACL_HasParameterConstraints(t *testing.T) {
+	acl := newTestACL(t, parametersPolicy)
+	require.True(t, acl.HasParameterConstraints("transit/rewrap/unseal-key"), "denied parameters")
+	require.True(t, acl.HasParameterConstraints("transit/encrypt/unseal-key"), "allowed and required parameters")
+	require.True(t, acl.HasParameterConstraints("transit/hmac/unseal-key"), "all parameters denied")
+	require.False(t, acl.HasParameterConstraints("transit/decrypt/unseal-key"))
+	require.False(t, acl.HasParameterConstraints("secret/unseal-key"), "no matching rule")
+}
+
+func TestParameterValueMatches(t *testing.T) {
+	tests := []struct {
+		item  interface{}
+		value interface{}
+		match bool
+	}{
+		{item: "abc", value: "abc", match: true},
+		{item: "abc", value: "abcd"},
+		{item: "ab*", value: "abcd", match: true},
+		{item: "*cd", value: "abcd", match: true},
+		{item: "*bc*", value: "abcd", match: true},
+		{item: "*", value: "abcd"},
+		{item: "*", value: "*", match: true},
+		{item: 1, value: float64(1), match: true},
+		{item: 1, value: "1", match: true},
+		{item: true, value: "false"},
+		{item: nil, value: nil, match: true},
+		{item: "abc", value: nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v %v", tt.item, tt.value), func(t *testing.T) {
+			require.Equal(t, tt.match, parameterValueMatches(tt.item, tt.value))
+		})
+	}
+}
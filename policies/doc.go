@@ -3,6 +3,8 @@ The keys module containing the keys CRUD operation and relationship CRUD
 
 hcl.go: Policy HCL Parser
 
+acl.go: matching of the request path against the policy paths
+
 models.go: definition of orm based data model
 
 routers.go: router binding and core logic
@@ -52,12 +52,15 @@ type ACLPermissions struct {
 }
 
 type HCLPolicyPathRules struct {
-	Path                string
-	Policy              string
-	Permissions         *ACLPermissions
-	IsPrefix            bool
-	HasSegmentWildcards bool
-	Capabilities        []string
+	Path                  string
+	Policy                string
+	Permissions           *ACLPermissions
+	IsPrefix              bool
+	HasSegmentWildcards   bool
+	Capabilities          []string
+	AllowedParametersHCL  map[string][]interface{} `hcl:"allowed_parameters"`
+	DeniedParametersHCL   map[string][]interface{} `hcl:"denied_parameters"`
+	RequiredParametersHCL []string                 `hcl:"required_parameters"`
 }
 
 type HCLPolicy struct {
@@ -118,6 +121,23 @@ func parsePaths(result *HCLPolicy, list *ast.ObjectList) error {
 			}
 		}
 
+		// Parameter names are case insensitive
+		if pc.AllowedParametersHCL != nil {
+			pc.Permissions.AllowedParameters = make(map[string][]interface{}, len(pc.AllowedParametersHCL))
+			for k, v := range pc.AllowedParametersHCL {
+				pc.Permissions.AllowedParameters[strings.ToLower(k)] = v
+			}
+		}
+		if pc.DeniedParametersHCL != nil {
+			pc.Permissions.DeniedParameters = make(map[string][]interface{}, len(pc.DeniedParametersHCL))
+			for k, v := range pc.DeniedParametersHCL {
+				pc.Permissions.DeniedParameters[strings.ToLower(k)] = v
+			}
+		}
+		for _, param := range pc.RequiredParametersHCL {
+			pc.Permissions.RequiredParameters = append(pc.Permissions.RequiredParameters, strings.ToLower(param))
+		}
+
 		pc.Permissions.CapabilitiesBitmap = 0
 		for _, cap := range pc.Capabilities {
 			switch cap {
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"github.com/miknikif/vault-auto-unseal/common"
 )
 
@@ -15,6 +16,16 @@ func PolicyRegister(router *gin.RouterGroup) {
 	router.POST("/:name", PolicyCreateOrUpdate)
 	router.PUT("/:name", PolicyCreateOrUpdate)
 	router.DELETE("/:name", PolicyDelete)
+	common.RegisterExistenceCheck(router.BasePath()+"/:name", PolicyExistenceCheck)
+}
+
+// Writes to the missing policy are creating it
+func PolicyExistenceCheck(c *gin.Context) (bool, error) {
+	_, err := FindOnePolicy(&PolicyModel{Name: c.Param("name")})
+	if gorm.IsRecordNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func PolicyList(c *gin.Context) {
@@ -54,10 +65,6 @@ func PolicyRetrieve(c *gin.Context) {
 }
 
 func PolicyCreateOrUpdate(c *gin.Context) {
-	if allowed := common.VerifyCreateAccess(c); !allowed {
-		c.JSON(http.StatusForbidden, common.NewError("auth", errors.New("permission denied")))
-		return
-	}
 	name := c.Param("name")
 	if name == "root" {
 		c.JSON(http.StatusBadRequest, common.NewError("policy", errors.New("Root policy update is forbidden")))
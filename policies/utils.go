@@ -15,6 +15,10 @@ func NewRootPolicy() *PolicyModel {
 func NewDefaultPolicy() *PolicyModel {
 	policyText := `path "auth/token/self-lookup" {
     capabilities = ["read"]
+}
+
+path "sys/capabilities-self" {
+    capabilities = ["update"]
 }`
 	return &PolicyModel{
 		Name: "default",
@@ -31,5 +35,6 @@ func GetCapabilitiesFromBitmap(bitmap uint32) map[string]bool {
 		ReadCapability:   bitmap&ReadCapabilityInt > 0,
 		ListCapability:   bitmap&ListCapabilityInt > 0,
 		DeleteCapability: bitmap&DeleteCapabilityInt > 0,
+		PatchCapability:  bitmap&PatchCapabilityInt > 0,
 	}
 }
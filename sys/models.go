@@ -1,6 +1,13 @@
 package sys
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/miknikif/vault-auto-unseal/barrier"
+)
 
 type HealthModel struct {
 	Type                       string
@@ -24,6 +31,11 @@ type HealthModel struct {
 	ServerTimeUTC              int64
 }
 
+type InitModel struct {
+	Keys      [][]byte
+	RootToken string
+}
+
 type LeaderStatusModel struct {
 	HAEnabled                       bool
 	ISSelf                          bool
@@ -37,14 +49,15 @@ type LeaderStatusModel struct {
 }
 
 func GetSealStatus() (HealthModel, error) {
+	status := barrier.GetSealStatus()
 	return HealthModel{
-		Type:        "shamir",
-		Initialized: true,
-		Sealed:      false,
-		T:           3,
-		N:           5,
-		Progress:    0,
-		Nonce:       "",
+		Type:        status.Type,
+		Initialized: status.Initialized,
+		Sealed:      status.Sealed,
+		T:           status.T,
+		N:           status.N,
+		Progress:    status.Progress,
+		Nonce:       status.Nonce,
 		// TODO: read following values from the app
 		Version:     "1.14.0",
 		BuildDate:   "2023-06-19T11:40:23Z",
@@ -58,9 +71,10 @@ func GetSealStatus() (HealthModel, error) {
 }
 
 func GetHealthStatus() (HealthModel, error) {
+	status := barrier.GetSealStatus()
 	return HealthModel{
-		Initialized:                true,
-		Sealed:                     false,
+		Initialized:                status.Initialized,
+		Sealed:                     status.Sealed,
 		Standby:                    true,
 		PerformanceStandby:         false,
 		ReplicationPerformanceMode: "disabled",
@@ -85,3 +99,15 @@ func GetLeaderStatus() (LeaderStatusModel, error) {
 		RAFTAppliedIndex:                108,
 	}, nil
 }
+
+// Random bytes are read from the crypto/rand, the same source used for the tokens and keys
+func GenerateRandomBytes(size int, format string) (string, error) {
+	bs := make([]byte, size)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	if format == RANDOM_FORMAT_HEX {
+		return hex.EncodeToString(bs), nil
+	}
+	return base64.StdEncoding.EncodeToString(bs), nil
+}
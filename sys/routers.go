@@ -4,8 +4,12 @@ import (
 	"errors"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/miknikif/vault-auto-unseal/barrier"
 	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/miknikif/vault-auto-unseal/tokens"
 	"net/http"
+	"strings"
 )
 
 func HealthRegister(router *gin.RouterGroup) {
@@ -14,6 +18,35 @@ func HealthRegister(router *gin.RouterGroup) {
 	router.GET("/health", HealthRetrieve)
 	router.GET("/seal-status", SealStatusRetrieve)
 	router.GET("/leader", LeaderStatusRetrieve)
+	router.GET("/init", InitStatusRetrieve)
+	router.PUT("/init", Init)
+	router.POST("/init", Init)
+	router.PUT("/unseal", Unseal)
+	router.POST("/unseal", Unseal)
+}
+
+// Routes which require authentication
+func SealRegister(router *gin.RouterGroup) {
+	router.PUT("/seal", Seal)
+	router.POST("/seal", Seal)
+}
+
+// Capabilities of the tokens, available to every token with the update on the path
+func CapabilitiesRegister(router *gin.RouterGroup) {
+	router.PUT("/capabilities", CapabilitiesRetrieve)
+	router.POST("/capabilities", CapabilitiesRetrieve)
+	router.PUT("/capabilities-self", CapabilitiesSelfRetrieve)
+	router.POST("/capabilities-self", CapabilitiesSelfRetrieve)
+	router.PUT("/capabilities-accessor", CapabilitiesAccessorRetrieve)
+	router.POST("/capabilities-accessor", CapabilitiesAccessorRetrieve)
+}
+
+// Random bytes are available under the sys/tools and transit paths
+func RandomRegister(router *gin.RouterGroup) {
+	router.PUT("/random", RandomRetrieve)
+	router.POST("/random", RandomRetrieve)
+	router.PUT("/random/:bytes", RandomRetrieve)
+	router.POST("/random/:bytes", RandomRetrieve)
 }
 
 // LivenessCheck
@@ -43,8 +76,14 @@ func HealthRetrieve(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("health", errors.New("Unable to get health")))
 		return
 	}
+	code := http.StatusOK
+	if !healthModel.Initialized {
+		code = http.StatusNotImplemented
+	} else if healthModel.Sealed {
+		code = http.StatusServiceUnavailable
+	}
 	serializer := HealthSerializer{c, healthModel}
-	c.JSON(http.StatusOK, serializer.Response())
+	c.JSON(code, serializer.Response())
 }
 
 // Using same status format as original vault is using
@@ -68,3 +107,144 @@ func LeaderStatusRetrieve(c *gin.Context) {
 	serializer := LeaderStatusSerializer{c, leaderStatusModel}
 	c.JSON(http.StatusOK, serializer.Response())
 }
+
+func InitStatusRetrieve(c *gin.Context) {
+	status := barrier.GetSealStatus()
+	c.JSON(http.StatusOK, InitStatusResponse{Initialized: status.Initialized})
+}
+
+// Generate the master key with the unseal keys and the root token
+// Secrets are returned only once in the response body
+func Init(c *gin.Context) {
+	initValidator := NewInitValidator()
+	if err := initValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("init", err))
+		return
+	}
+	if status := barrier.GetSealStatus(); status.Initialized {
+		c.JSON(http.StatusBadRequest, common.NewError("init", errors.New("server is already initialized")))
+		return
+	}
+	// Root token is saved together with the barrier, so the server can't be left initialized without it
+	rootToken := tokens.NewRootToken()
+	keys, err := barrier.Initialize(initValidator.SecretShares, initValidator.SecretThreshold, func(tx *gorm.DB) error {
+		return tx.Save(rootToken).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("init", err))
+		return
+	}
+	serializer := InitSerializer{c, InitModel{Keys: keys, RootToken: rootToken.TokenID}}
+	c.JSON(http.StatusOK, serializer.Response())
+}
+
+// Provide one of the unseal keys, response contains the current seal status
+func Unseal(c *gin.Context) {
+	unsealValidator := NewUnsealValidator()
+	if err := unsealValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("unseal", err))
+		return
+	}
+	if unsealValidator.Reset {
+		barrier.ResetUnseal()
+	} else if err := barrier.Unseal(unsealValidator.key); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("unseal", err))
+		return
+	}
+	SealStatusRetrieve(c)
+}
+
+func Seal(c *gin.Context) {
+	if allowed := common.VerifySudoAccess(c); !allowed {
+		c.JSON(http.StatusForbidden, common.NewError("auth", errors.New("permission denied")))
+		return
+	}
+	if err := barrier.Seal(); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("seal", err))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// Random bytes from the platform source, same format as original vault is using
+func RandomRetrieve(c *gin.Context) {
+	randomValidator := NewRandomValidator()
+	if err := randomValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("random", err))
+		return
+	}
+	randomBytes, err := GenerateRandomBytes(randomValidator.bytes, randomValidator.Format)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("random", err))
+		return
+	}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, RandomResponse{RandomBytes: randomBytes}))
+}
+
+// Capabilities of the token provided in the request
+func CapabilitiesRetrieve(c *gin.Context) {
+	capabilitiesValidator := NewCapabilitiesValidator()
+	if err := capabilitiesValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", err))
+		return
+	}
+	if capabilitiesValidator.Token == "" {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", errors.New("token should be specified")))
+		return
+	}
+	tokenModel, err := tokens.FindOneToken(&tokens.TokenModel{TokenID: capabilitiesValidator.Token})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", errors.New("invalid token")))
+		return
+	}
+	respondCapabilities(c, tokenModel, capabilitiesValidator.Paths)
+}
+
+// Capabilities of the token used for the request
+func CapabilitiesSelfRetrieve(c *gin.Context) {
+	capabilitiesValidator := NewCapabilitiesValidator()
+	if err := capabilitiesValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", err))
+		return
+	}
+	tokenModel, ok := c.MustGet(common.VAULT_TOKEN_MODEL).(tokens.TokenModel)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, common.NewError("capabilities", errors.New("Unable to get the token of the request")))
+		return
+	}
+	respondCapabilities(c, tokenModel, capabilitiesValidator.Paths)
+}
+
+// Capabilities of the token with the accessor provided in the request
+func CapabilitiesAccessorRetrieve(c *gin.Context) {
+	capabilitiesValidator := NewCapabilitiesValidator()
+	if err := capabilitiesValidator.Bind(c); err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", err))
+		return
+	}
+	if capabilitiesValidator.Accessor == "" {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", errors.New("accessor should be specified")))
+		return
+	}
+	tokenModel, err := tokens.FindOneToken(&tokens.TokenModel{Accessor: capabilitiesValidator.Accessor})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, common.NewError("capabilities", errors.New("invalid accessor")))
+		return
+	}
+	respondCapabilities(c, tokenModel, capabilitiesValidator.Paths)
+}
+
+// Evaluate the paths with the same ACL which is used to authorize the requests of the token
+func respondCapabilities(c *gin.Context, tokenModel tokens.TokenModel, paths []string) {
+	acl, err := tokens.GetTokenACL(tokenModel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("capabilities", err))
+		return
+	}
+	capabilities := map[string][]string{}
+	for _, path := range paths {
+		capabilities[path] = acl.Capabilities(strings.TrimPrefix(path, "/"))
+	}
+	serializer := CapabilitiesSerializer{c, paths, capabilities}
+	c.JSON(http.StatusOK, common.NewGenericResponse(c, serializer.Response()))
+}
@@ -0,0 +1,371 @@
+package sys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/miknikif/vault-auto-unseal/barrier"
+	"github.com/miknikif/vault-auto-unseal/common"
+	"github.com/miknikif/vault-auto-unseal/keys"
+	"github.com/miknikif/vault-auto-unseal/policies"
+	"github.com/miknikif/vault-auto-unseal/tokens"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testRouter *gin.Engine
+	rootToken  string
+	unsealKeys []string
+)
+
+// Server is set up with the fresh DB and the routes of the real server,
+// it's initialized with the unseal keys and unsealed before the tests
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "vau-sys")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_DB_PATH), dir)
+	os.Setenv(fmt.Sprintf("%s_%s", common.ENV_PREFIX, common.ENV_LOG_LEVEL), "error")
+
+	conf, err := common.GetConfig()
+	if err != nil {
+		panic(err)
+	}
+	conf.DB.AutoMigrate(&policies.PolicyModel{}, &tokens.TokenModel{}, &keys.AESKeyModel{}, &keys.KeyModel{}, &keys.WrappingKeyModel{}, &keys.KeyCacheConfigModel{}, &barrier.BarrierModel{})
+	if err := policies.SeedDB(conf); err != nil {
+		panic(err)
+	}
+	if err := barrier.Setup(conf); err != nil {
+		panic(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	testRouter = gin.New()
+	testRouter.Use(common.JSONMiddleware(false))
+	testRouter.Use(common.RequestIDMiddleware())
+	HealthRegister(testRouter.Group("/v1/sys"))
+	v1 := testRouter.Group("/v1")
+	v1.Use(tokens.AuthMiddleware())
+	SealRegister(v1.Group("/sys"))
+	CapabilitiesRegister(v1.Group("/sys"))
+	tokens.TokenRegister(v1.Group("/auth/token"))
+	policies.PolicyRegister(v1.Group("/sys/policy"))
+	keys.KeysOperationsRegister(v1.Group("/transit"))
+	RandomRegister(v1.Group("/sys/tools"))
+	RandomRegister(v1.Group("/transit"))
+
+	var res InitResponse
+	w := serveRequest(http.MethodPut, "/v1/sys/init", "", `{"secret_shares":3,"secret_threshold":2}`)
+	if w.Code != http.StatusOK {
+		panic(w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		panic(err)
+	}
+	rootToken = res.RootToken
+	unsealKeys = res.Keys
+	for _, key := range unsealKeys[:2] {
+		serveRequest(http.MethodPut, "/v1/sys/unseal", "", fmt.Sprintf(`{"key":%q}`, key))
+	}
+	if barrier.IsSealed() {
+		panic("server is still sealed")
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func serveRequest(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set(common.VAULT_TOKEN_HEADER, token)
+	}
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+// Decode the data of the response into the provided value
+func performDataRequest(t *testing.T, method string, path string, token string, body string, data interface{}) (int, []string) {
+	res := struct {
+		Data   interface{} `json:"data"`
+		Errors []string    `json:"errors"`
+	}{Data: data}
+	w := serveRequest(method, path, token, body)
+	if w.Body.Len() > 0 {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	}
+	return w.Code, res.Errors
+}
+
+func unsealTestServer(t *testing.T, keys []string) SealStatusResponse {
+	var status SealStatusResponse
+	for _, key := range keys {
+		w := serveRequest(http.MethodPut, "/v1/sys/unseal", "", fmt.Sprintf(`{"key":%q}`, key))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	}
+	return status
+}
+
+// Key material isn't available while the server is sealed, tokens and the random bytes don't need it
+func TestSeal_TransitUnavailable(t *testing.T) {
+	code, errs := performDataRequest(t, http.MethodPut, "/v1/transit/keys/sealed", rootToken, "{}", nil)
+	require.Equal(t, http.StatusOK, code, errs)
+
+	w := serveRequest(http.MethodPut, "/v1/sys/seal", rootToken, "")
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	require.True(t, barrier.IsSealed())
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: http.MethodGet, path: "/v1/transit/keys/sealed"},
+		{method: http.MethodPut, path: "/v1/transit/keys/created", body: "{}"},
+		{method: http.MethodPut, path: "/v1/transit/encrypt/sealed", body: `{"plaintext":"dGVzdA=="}`},
+		{method: http.MethodPut, path: "/v1/transit/decrypt/sealed", body: `{"ciphertext":"vault:v1:AAAA"}`},
+		{method: http.MethodPost, path: "/v1/transit/sign/sealed", body: `{"input":"dGVzdA=="}`},
+		{method: http.MethodPost, path: "/v1/transit/hmac/sealed", body: `{"input":"dGVzdA=="}`},
+	}
+	for _, r := range requests {
+		code, errs = performDataRequest(t, r.method, r.path, rootToken, r.body, nil)
+		require.Equal(t, http.StatusServiceUnavailable, code, r.path)
+		require.NotEmpty(t, errs, r.path)
+	}
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/sys/tools/random", rootToken, "", nil)
+	require.Equal(t, http.StatusOK, code, errs)
+
+	status := unsealTestServer(t, unsealKeys[1:2])
+	require.True(t, status.Sealed)
+	require.Equal(t, 1, status.Progress)
+	code, _ = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/sealed", rootToken, `{"plaintext":"dGVzdA=="}`, nil)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	status = unsealTestServer(t, unsealKeys[2:])
+	require.False(t, status.Sealed)
+	require.Equal(t, 0, status.Progress)
+	code, errs = performDataRequest(t, http.MethodPut, "/v1/transit/encrypt/sealed", rootToken, `{"plaintext":"dGVzdA=="}`, nil)
+	require.Equal(t, http.StatusOK, code, errs)
+}
+
+func createTestPolicy(t *testing.T, name string, policy string) {
+	w := serveRequest(http.MethodPut, "/v1/sys/policy/"+name, rootToken, fmt.Sprintf(`{"policy":%q}`, policy))
+	require.Contains(t, []int{http.StatusOK, http.StatusNoContent}, w.Code, w.Body.String())
+}
+
+func createTestToken(t *testing.T, policies ...string) string {
+	var token tokens.TokenResponse
+	body, err := json.Marshal(map[string]interface{}{"policies": policies, "ttl": "1h", "explicit_max_ttl": "0s", "period": "0s", "type": "service"})
+	require.NoError(t, err)
+	code, errs := performDataRequest(t, http.MethodPost, "/v1/auth/token/create", rootToken, string(body), &token)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.NotEmpty(t, token.TokenID)
+	return token.TokenID
+}
+
+func TestRandom(t *testing.T) {
+	for _, r := range []struct {
+		path   string
+		body   string
+		size   int
+		decode func(string) ([]byte, error)
+	}{
+		{path: "/v1/sys/tools/random", size: DEFAULT_RANDOM_BYTES, decode: base64.StdEncoding.DecodeString},
+		{path: "/v1/sys/tools/random", body: `{"bytes":16}`, size: 16, decode: base64.StdEncoding.DecodeString},
+		{path: "/v1/sys/tools/random", body: `{"bytes":"24","format":"hex"}`, size: 24, decode: hex.DecodeString},
+		{path: "/v1/sys/tools/random/8", body: `{"bytes":64}`, size: 8, decode: base64.StdEncoding.DecodeString},
+		{path: "/v1/transit/random/48", body: `{"format":"hex","source":"platform"}`, size: 48, decode: hex.DecodeString},
+	} {
+		var res RandomResponse
+		code, errs := performDataRequest(t, http.MethodPost, r.path, rootToken, r.body, &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		bs, err := r.decode(res.RandomBytes)
+		require.NoError(t, err, r.path+" "+r.body)
+		require.Len(t, bs, r.size, r.path+" "+r.body)
+	}
+
+	for _, r := range []struct {
+		path string
+		body string
+	}{
+		{path: "/v1/sys/tools/random", body: `{"bytes":0}`},
+		{path: "/v1/sys/tools/random", body: fmt.Sprintf(`{"bytes":%d}`, MAX_RANDOM_BYTES+1)},
+		{path: "/v1/sys/tools/random/many"},
+		{path: "/v1/sys/tools/random", body: `{"format":"base32"}`},
+		{path: "/v1/sys/tools/random", body: `{"source":"seal"}`},
+		{path: "/v1/transit/random", body: `{"source":"all"}`},
+	} {
+		code, errs := performDataRequest(t, http.MethodPost, r.path, rootToken, r.body, nil)
+		require.Equal(t, http.StatusBadRequest, code, r.path+" "+r.body)
+		require.NotEmpty(t, errs)
+	}
+}
+
+// Random bytes of the sys/tools and transit mounts are gated by their own paths
+func TestRandom_Policy(t *testing.T) {
+	createTestPolicy(t, "random-tools", `path "sys/tools/random*" { capabilities = ["update"] }`)
+	createTestPolicy(t, "random-transit", `path "transit/random" { capabilities = ["update"] }`)
+	tools := createTestToken(t, "random-tools")
+	transit := createTestToken(t, "random-transit")
+
+	for _, r := range []struct {
+		token string
+		path  string
+		code  int
+	}{
+		{token: tools, path: "/v1/sys/tools/random", code: http.StatusOK},
+		{token: tools, path: "/v1/sys/tools/random/16", code: http.StatusOK},
+		{token: tools, path: "/v1/transit/random", code: http.StatusForbidden},
+		{token: transit, path: "/v1/transit/random", code: http.StatusOK},
+		{token: transit, path: "/v1/transit/random/16", code: http.StatusForbidden},
+		{token: transit, path: "/v1/sys/tools/random", code: http.StatusForbidden},
+		{token: "", path: "/v1/sys/tools/random", code: http.StatusForbidden},
+	} {
+		code, errs := performDataRequest(t, http.MethodPost, r.path, r.token, "", nil)
+		require.Equal(t, r.code, code, "%s %v", r.path, errs)
+	}
+}
+
+// Parameters are read from the form bodies and the query, and only when the matching rule restricts them
+func TestParameterConstraints(t *testing.T) {
+	createTestPolicy(t, "parameters", `
+path "sys/policy/parameters-*" {
+  capabilities = ["create", "update"]
+  allowed_parameters = {
+    "policy" = []
+  }
+}
+
+path "transit/encrypt/*" {
+  capabilities = ["update"]
+  denied_parameters = {
+    "key_version" = []
+  }
+}
+
+path "transit/keys/*" {
+  capabilities = ["create", "update"]
+}
+`)
+	token := createTestToken(t, "parameters")
+
+	request := func(method string, path string, contentType string, body string) int {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(common.VAULT_TOKEN_HEADER, token)
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w.Code
+	}
+	form := "application/x-www-form-urlencoded"
+	policy := url.Values{"policy": {`path "transit/keys" { capabilities = ["list"] }`}}
+
+	require.Equal(t, http.StatusOK, request(http.MethodPut, "/v1/sys/policy/parameters-form", form, policy.Encode()))
+	policy.Set("name", "other")
+	require.Equal(t, http.StatusForbidden, request(http.MethodPut, "/v1/sys/policy/parameters-other", form, policy.Encode()))
+
+	require.Equal(t, http.StatusOK, request(http.MethodPut, "/v1/transit/keys/parameters", "application/json", "{}"))
+	require.Equal(t, http.StatusOK, request(http.MethodPut, "/v1/transit/encrypt/parameters", "application/json", `{"plaintext":"dGVzdA=="}`))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPut, "/v1/transit/encrypt/parameters", "application/json", `{"plaintext":"dGVzdA==","key_version":1}`))
+	require.Equal(t, http.StatusForbidden, request(http.MethodPut, "/v1/transit/encrypt/parameters?key_version=1", "application/json", `{"plaintext":"dGVzdA=="}`))
+
+	// Body isn't read for the rule without the constraints, the handler reports the invalid body itself
+	code := request(http.MethodPut, "/v1/transit/keys/parameters/rotate", form, "force=true")
+	require.NotEqual(t, http.StatusForbidden, code)
+}
+
+// Token creation has no existence check, so it's an update in the same way as in Vault
+func TestTokenCreate_Capability(t *testing.T) {
+	createTestPolicy(t, "token-create", `path "auth/token/create" { capabilities = ["create"] }`)
+	createTestPolicy(t, "token-update", `path "auth/token/create" { capabilities = ["update"] }`)
+	body := `{"ttl":"1h","explicit_max_ttl":"0s","period":"0s","type":"service"}`
+
+	code, _ := performDataRequest(t, http.MethodPost, "/v1/auth/token/create", createTestToken(t, "token-create"), body, nil)
+	require.Equal(t, http.StatusForbidden, code)
+
+	var token tokens.TokenResponse
+	code, errs := performDataRequest(t, http.MethodPost, "/v1/auth/token/create", createTestToken(t, "token-update"), body, &token)
+	require.Equal(t, http.StatusOK, code, errs)
+	require.NotEmpty(t, token.TokenID)
+}
+
+// Capabilities are reported by the same ACL which authorizes the requests of the token
+func TestCapabilities(t *testing.T) {
+	createTestPolicy(t, "capabilities-keys", `
+path "transit/keys/*" {
+  capabilities = ["read", "update"]
+}
+
+path "transit/keys/unseal-key" {
+  capabilities = ["read", "create", "update"]
+}
+
+path "sys/policy" {
+  capabilities = ["list"]
+}
+`)
+	createTestPolicy(t, "capabilities-deny", `path "transit/keys/unseal-key" { capabilities = ["deny"] }`)
+	keys := createTestToken(t, "default", "capabilities-keys")
+	denied := createTestToken(t, "default", "capabilities-keys", "capabilities-deny")
+	tokenModel, err := tokens.FindOneToken(&tokens.TokenModel{TokenID: keys})
+	require.NoError(t, err)
+
+	capabilities := func(path string, token string, body string) map[string][]string {
+		res := map[string][]string{}
+		code, errs := performDataRequest(t, http.MethodPost, path, token, body, &res)
+		require.Equal(t, http.StatusOK, code, errs)
+		return res
+	}
+	paths := `"paths":["transit/keys/unseal-key","/transit/keys/other","sys/policy/","sys/seal"]`
+	expected := map[string][]string{
+		"transit/keys/unseal-key": {"read", "update", "create"},
+		"/transit/keys/other":     {"read", "update"},
+		"sys/policy/":             {"list"},
+		"sys/seal":                {"deny"},
+	}
+	require.Equal(t, expected, capabilities("/v1/sys/capabilities", rootToken, fmt.Sprintf(`{"token":%q,%s}`, keys, paths)))
+	require.Equal(t, expected, capabilities("/v1/sys/capabilities-self", keys, fmt.Sprintf(`{%s}`, paths)))
+	require.Equal(t, expected, capabilities("/v1/sys/capabilities-accessor", rootToken, fmt.Sprintf(`{"accessor":%q,%s}`, tokenModel.Accessor, paths)))
+
+	// Deny of the other policy wins over the exact rule
+	res := capabilities("/v1/sys/capabilities-self", denied, `{"path":"transit/keys/unseal-key"}`)
+	require.Equal(t, []string{"deny"}, res["capabilities"])
+	require.Equal(t, []string{"deny"}, res["transit/keys/unseal-key"])
+
+	res = capabilities("/v1/sys/capabilities-self", rootToken, `{"paths":["transit/keys/unseal-key","sys/seal"]}`)
+	require.Equal(t, map[string][]string{"transit/keys/unseal-key": {"root"}, "sys/seal": {"root"}}, res)
+	res = capabilities("/v1/sys/capabilities", rootToken, fmt.Sprintf(`{"token":%q,"path":"sys/seal"}`, rootToken))
+	require.Equal(t, []string{"root"}, res["capabilities"])
+
+	for _, r := range []struct {
+		path string
+		body string
+	}{
+		{path: "/v1/sys/capabilities-accessor", body: `{"accessor":"unknown","paths":["sys/seal"]}`},
+		{path: "/v1/sys/capabilities-accessor", body: `{"paths":["sys/seal"]}`},
+		{path: "/v1/sys/capabilities", body: `{"token":"hvs.unknown","paths":["sys/seal"]}`},
+		{path: "/v1/sys/capabilities", body: fmt.Sprintf(`{"token":%q}`, keys)},
+	} {
+		code, errs := performDataRequest(t, http.MethodPost, r.path, rootToken, r.body, nil)
+		require.Equal(t, http.StatusBadRequest, code, r.body)
+		require.NotEmpty(t, errs, r.body)
+	}
+
+	// Capabilities of the other tokens aren't available without the update on the path
+	code, _ := performDataRequest(t, http.MethodPost, "/v1/sys/capabilities-accessor", keys, fmt.Sprintf(`{"accessor":%q,"path":"sys/seal"}`, tokenModel.Accessor), nil)
+	require.Equal(t, http.StatusForbidden, code)
+}
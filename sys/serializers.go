@@ -1,9 +1,44 @@
 package sys
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+
 	"github.com/gin-gonic/gin"
 )
 
+type InitStatusResponse struct {
+	Initialized bool `json:"initialized"`
+}
+
+type InitSerializer struct {
+	C *gin.Context
+	InitModel
+}
+
+type InitResponse struct {
+	Keys       []string `json:"keys"`
+	KeysBase64 []string `json:"keys_base64"`
+	RootToken  string   `json:"root_token"`
+}
+
+func (s *InitSerializer) Response() InitResponse {
+	response := InitResponse{
+		Keys:       []string{},
+		KeysBase64: []string{},
+		RootToken:  s.RootToken,
+	}
+	for _, key := range s.Keys {
+		response.Keys = append(response.Keys, hex.EncodeToString(key))
+		response.KeysBase64 = append(response.KeysBase64, base64.StdEncoding.EncodeToString(key))
+	}
+	return response
+}
+
+type RandomResponse struct {
+	RandomBytes string `json:"random_bytes"`
+}
+
 type SealStatusSerializer struct {
 	C *gin.Context
 	HealthModel
@@ -111,3 +146,21 @@ func (s *LeaderStatusSerializer) Response() LeaderStatusResponse {
 	}
 	return response
 }
+
+type CapabilitiesSerializer struct {
+	C            *gin.Context
+	Paths        []string
+	Capabilities map[string][]string
+}
+
+// Capabilities of the single path are also returned under the capabilities key, like Vault does it
+func (s *CapabilitiesSerializer) Response() map[string][]string {
+	response := map[string][]string{}
+	for _, path := range s.Paths {
+		response[path] = s.Capabilities[path]
+	}
+	if len(s.Paths) == 1 {
+		response["capabilities"] = s.Capabilities[s.Paths[0]]
+	}
+	return response
+}
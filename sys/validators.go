@@ -1,12 +1,125 @@
-// Actually everything described in this file isn't used right now
+// Status validators described in this file aren't used right now
 // We're not saving anything from this package to the DB
 package sys
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
 	"github.com/gin-gonic/gin"
 	"github.com/miknikif/vault-auto-unseal/common"
 )
 
+type InitValidator struct {
+	SecretShares    int `json:"secret_shares"`
+	SecretThreshold int `json:"secret_threshold"`
+}
+
+// Body is optional, no params are required when the master key is provided by the config
+func (s *InitValidator) Bind(c *gin.Context) error {
+	err := common.BindJSON(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func NewInitValidator() InitValidator {
+	return InitValidator{}
+}
+
+const (
+	RANDOM_FORMAT_BASE64   = "base64"
+	RANDOM_FORMAT_HEX      = "hex"
+	RANDOM_SOURCE_PLATFORM = "platform"
+	DEFAULT_RANDOM_BYTES   = 32
+	MAX_RANDOM_BYTES       = 128 * 1024
+)
+
+// Bytes from the URL takes precedence over the bytes from the body
+type RandomValidator struct {
+	Bytes  common.OptionalField `json:"bytes"`
+	Format string               `json:"format"`
+	Source string               `json:"source"`
+	bytes  int                  `json:"-"`
+}
+
+func (s *RandomValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if bytes := c.Param("bytes"); bytes != "" {
+		s.Bytes = common.OptionalField{Value: bytes, Set: true}
+	}
+	s.bytes = DEFAULT_RANDOM_BYTES
+	if s.Bytes.Value != "" {
+		s.bytes = common.ParseInt(s.Bytes.Value, 0)
+	}
+	if s.bytes < 1 || s.bytes > MAX_RANDOM_BYTES {
+		return fmt.Errorf("bytes should be between 1 and %d", MAX_RANDOM_BYTES)
+	}
+
+	if s.Format == "" {
+		s.Format = RANDOM_FORMAT_BASE64
+	}
+	if s.Format != RANDOM_FORMAT_BASE64 && s.Format != RANDOM_FORMAT_HEX {
+		return fmt.Errorf("format should be %q or %q", RANDOM_FORMAT_BASE64, RANDOM_FORMAT_HEX)
+	}
+
+	if s.Source == "" {
+		s.Source = RANDOM_SOURCE_PLATFORM
+	}
+	if s.Source != RANDOM_SOURCE_PLATFORM {
+		return fmt.Errorf("only the %q source is supported", RANDOM_SOURCE_PLATFORM)
+	}
+	return nil
+}
+
+func NewRandomValidator() RandomValidator {
+	return RandomValidator{}
+}
+
+type UnsealValidator struct {
+	Key   string `json:"key"`
+	Reset bool   `json:"reset"`
+	key   []byte `json:"-"`
+}
+
+func (s *UnsealValidator) Bind(c *gin.Context) error {
+	err := common.BindJSON(c, s)
+	if err != nil {
+		return err
+	}
+
+	if s.Reset {
+		return nil
+	}
+
+	if s.Key == "" {
+		return errors.New("key should be specified")
+	}
+
+	key, err := hex.DecodeString(s.Key)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(s.Key)
+		if err != nil {
+			return errors.New("key should be hex or base64 encoded")
+		}
+	}
+	s.key = key
+
+	return nil
+}
+
+func NewUnsealValidator() UnsealValidator {
+	return UnsealValidator{}
+}
+
 type SealStatusModelValidator struct {
 	Health struct {
 		Type         string `json:"type"`
@@ -176,3 +289,30 @@ func NewLeaderStatusModelValidatorFillWith(leaderStatusModel LeaderStatusModel)
 	leaderStatusModelValidator.LeaderStatus.RAFTAppliedIndex = leaderStatusModel.RAFTAppliedIndex
 	return leaderStatusModelValidator
 }
+
+// Single path is still accepted for the compatibility with the older Vault clients
+type CapabilitiesValidator struct {
+	Token    string   `json:"token"`
+	Accessor string   `json:"accessor"`
+	Paths    []string `json:"paths"`
+	Path     string   `json:"path"`
+}
+
+func (s *CapabilitiesValidator) Bind(c *gin.Context) error {
+	err := common.Bind(c, s)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if s.Path != "" {
+		s.Paths = append(s.Paths, s.Path)
+	}
+	if len(s.Paths) == 0 {
+		return errors.New("paths should be specified")
+	}
+	return nil
+}
+
+func NewCapabilitiesValidator() CapabilitiesValidator {
+	return CapabilitiesValidator{}
+}
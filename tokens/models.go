@@ -168,12 +168,3 @@ func DeleteTokenModel(condition interface{}) error {
 	l.Debug("Finished delete the TokenModel from the DB", "token", condition)
 	return err
 }
-
-func SeedDB(c *common.Config) error {
-	rootToken := NewRootToken()
-	if err := SaveOne(rootToken); err != nil {
-		return err
-	}
-	c.Logger.Warn("New root token was created. Please save it in the safe place!", "tokenID", rootToken.TokenID, "accessor", rootToken.Accessor)
-	return nil
-}
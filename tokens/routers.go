@@ -20,13 +20,10 @@ func TokenRegister(router *gin.RouterGroup) {
 	router.POST("/revoke", TokenDelete)
 	router.PUT("/revoke", TokenDelete)
 	router.POST("/revoke-accessor", TokenDelete)
+	// No existence check is registered for the token creation, so it requires the update capability like in Vault
 }
 
 func TokenCreate(c *gin.Context) {
-	if allowed := common.VerifyCreateAccess(c); !allowed {
-		c.JSON(http.StatusForbidden, common.NewError("auth", errors.New("permission denied")))
-		return
-	}
 	l, _ := common.GetLogger()
 	tokenModelValidator := NewTokenModelValidator()
 	if err := tokenModelValidator.Bind(c); err != nil {
@@ -1,14 +1,19 @@
 package tokens
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/miknikif/vault-auto-unseal/common"
 	"github.com/miknikif/vault-auto-unseal/policies"
 )
@@ -66,79 +71,168 @@ func NewRootToken() *TokenModel {
 	}
 }
 
-func validateOperation(c *gin.Context) (bool, error) {
+// Parse the policies attached to the token, root policy is returned without the rules
+func GetTokenPolicies(tokenModel TokenModel) ([]policies.HCLPolicy, error) {
 	l, _ := common.GetLogger()
-	tokenID := c.Request.Header.Get(common.VAULT_TOKEN_HEADER)
-	if tokenID == "" {
-		return false, errors.New("token must be provided")
-	}
-	tokenModel, err := FindOneToken(&TokenModel{TokenID: tokenID})
-	if err != nil {
-		return false, errors.New("Unable to verify the token")
-	}
-
-	c.Set(common.VAULT_TOKEN, tokenID)
-	c.Set(common.VAULT_TOKEN_MODEL, tokenModel)
-	c.Set(common.IS_ROOT, false)
-
 	l.Trace("Attached policies", "policies", tokenModel.Policies)
 	hclPolicies := []policies.HCLPolicy{}
 	for _, policy := range tokenModel.Policies {
 		if policy.Name == "root" {
-			l.Trace("Found Root policy attached, skipping auth", "policy", policy)
-			c.Set(common.IS_ROOT, true)
-			return true, nil
+			hclPolicies = append(hclPolicies, policies.HCLPolicy{Name: policy.Name})
+			continue
 		}
 		policyModel, err := policies.FindOnePolicy(&policy)
 		if err != nil {
-			return false, errors.New("Unable to retrieve policy")
+			return nil, errors.New("Unable to retrieve policy")
 		}
 		text, err := common.DecFromB64(policyModel.Text)
 		if err != nil {
-			return false, errors.New("Unable to decode policy text")
+			return nil, errors.New("Unable to decode policy text")
 		}
 		hclPolicy, err := policies.ParseHCLPolicy(text)
 		if err != nil {
-			return false, errors.New("Unable to parse attached policies")
+			return nil, errors.New("Unable to parse attached policies")
 		}
 		hclPolicy.Name = policy.Name
 		hclPolicies = append(hclPolicies, *hclPolicy)
 	}
+	return hclPolicies, nil
+}
+
+// Build the ACL from the policies attached to the token
+func GetTokenACL(tokenModel TokenModel) (*policies.ACL, error) {
+	hclPolicies, err := GetTokenPolicies(tokenModel)
+	if err != nil {
+		return nil, err
+	}
+	return policies.NewACL(hclPolicies), nil
+}
+
+func validateOperation(c *gin.Context) (bool, error) {
+	l, _ := common.GetLogger()
+	tokenID := c.Request.Header.Get(common.VAULT_TOKEN_HEADER)
+	if tokenID == "" {
+		return false, errors.New("token must be provided")
+	}
+	tokenModel, err := FindOneToken(&TokenModel{TokenID: tokenID})
+	if err != nil {
+		return false, errors.New("Unable to verify the token")
+	}
+
+	c.Set(common.VAULT_TOKEN, tokenID)
+	c.Set(common.VAULT_TOKEN_MODEL, tokenModel)
+	c.Set(common.IS_ROOT, false)
+
+	hclPolicies, err := GetTokenPolicies(tokenModel)
+	if err != nil {
+		return false, err
+	}
+
+	acl := policies.NewACL(hclPolicies)
+	if acl.IsRoot() {
+		l.Trace("Found Root policy attached, skipping auth")
+		c.Set(common.IS_ROOT, true)
+		return true, nil
+	}
 
 	c.Set(common.SESSION_POLICIES, hclPolicies)
+	c.Set(common.SESSION_ACL, acl)
 
 	requestPath := common.GetRequestPath(c)
 	l.Trace("Found auth token validating", "path", requestPath)
-	for _, hclPolicy := range hclPolicies {
-		for _, path := range hclPolicy.Paths {
-			if requestPath == path.Path {
-				l.Trace("Found matching policy path", "path", path.Path, "policy", hclPolicy.Name)
-				list, _ := strconv.ParseBool(c.Query("list"))
-				requestType := c.Request.Method
-				capabilitiesBitmap := path.Permissions.CapabilitiesBitmap
-				capabilities := policies.GetCapabilitiesFromBitmap(capabilitiesBitmap)
-				c.Set(common.PATH_CAPABILITIES, capabilities)
-				if capabilities[policies.DenyCapability] {
-					return false, nil
-				}
-				if list {
-					return capabilities[policies.ListCapability], nil
-				}
-				switch requestType {
-				case "GET":
-					return capabilities[policies.ReadCapability], nil
-				case "POST":
-					return capabilities[policies.UpdateCapability], nil
-				case "PUT":
-					return capabilities[policies.UpdateCapability], nil
-				case "DELETE":
-					return capabilities[policies.DeleteCapability], nil
-				default:
-					return false, nil
-				}
+	list, _ := strconv.ParseBool(c.Query("list"))
+	capability := policies.ListCapability
+	if !list {
+		switch c.Request.Method {
+		case "GET":
+			capability = policies.ReadCapability
+		case "POST", "PUT":
+			capability = policies.UpdateCapability
+			exists, err := common.CheckExistence(c)
+			if err != nil {
+				return false, errors.New("Unable to check if the resource exists")
+			}
+			if !exists {
+				capability = policies.CreateCapability
 			}
+		case "DELETE":
+			capability = policies.DeleteCapability
+		default:
+			return false, nil
 		}
 	}
+	if !acl.HasCapability(requestPath, capability) {
+		return false, nil
+	}
+	if capability != policies.UpdateCapability && capability != policies.CreateCapability {
+		return true, nil
+	}
+	if !acl.HasParameterConstraints(requestPath) {
+		return true, nil
+	}
+	data, err := getRequestParameters(c)
+	if err != nil {
+		return false, err
+	}
+	if err := acl.CheckParameters(requestPath, data); err != nil {
+		return false, fmt.Errorf("permission denied: %w", err)
+	}
+	return true, nil
+}
+
+// Memory used to parse the multipart forms, the same as the gin default
+const MAX_MULTIPART_MEMORY = 32 << 20
 
-	return false, nil
+// Read the parameters of the request, the body is decoded by its Content-Type in the same way as common.Bind does it
+// and it's restored for the handlers, query parameters are merged in and the body takes precedence over them
+func getRequestParameters(c *gin.Context) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	for name, values := range c.Request.URL.Query() {
+		data[name] = formValue(values)
+	}
+	if c.Request.Body == nil {
+		return data, nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return data, nil
+	}
+
+	switch c.ContentType() {
+	case binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+		// Form is parsed on the copy of the request, so the handlers are parsing it again from the restored body
+		req := c.Request.Clone(c.Request.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err := req.ParseMultipartForm(MAX_MULTIPART_MEMORY); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return nil, errors.New("unable to parse the request form")
+		}
+		for name, values := range req.PostForm {
+			data[name] = formValue(values)
+		}
+	default:
+		params := map[string]interface{}{}
+		if err := json.Unmarshal(body, &params); err != nil {
+			return nil, errors.New("request body should be a JSON object")
+		}
+		for name, value := range params {
+			data[name] = value
+		}
+	}
+	return data, nil
+}
+
+// Single value of the form or query parameter is returned as a string, several values as a list
+func formValue(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
 }
@@ -0,0 +1,78 @@
+package tokens
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestContext(target string, contentType string, body string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+	if contentType != "" {
+		c.Request.Header.Set("Content-Type", contentType)
+	}
+	return c
+}
+
+// Handlers should be able to read the body after the parameters were checked
+func requireRestoredBody(t *testing.T, c *gin.Context, body string) {
+	restored, err := io.ReadAll(c.Request.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, string(restored))
+}
+
+func TestGetRequestParameters(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		data        map[string]interface{}
+	}{
+		{name: "empty body", target: "/v1/transit/encrypt/key", data: map[string]interface{}{}},
+		{name: "json", target: "/v1/transit/encrypt/key", contentType: "application/json", body: `{"plaintext":"dGVzdA==","key_version":2}`, data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": float64(2)}},
+		{name: "json without content type", target: "/v1/transit/encrypt/key", body: `{"plaintext":"dGVzdA=="}`, data: map[string]interface{}{"plaintext": "dGVzdA=="}},
+		{name: "form", target: "/v1/transit/encrypt/key", contentType: "application/x-www-form-urlencoded", body: "plaintext=dGVzdA%3D%3D&context=a&context=b", data: map[string]interface{}{"plaintext": "dGVzdA==", "context": []interface{}{"a", "b"}}},
+		{name: "query", target: "/v1/transit/encrypt/key?key_version=2", data: map[string]interface{}{"key_version": "2"}},
+		{name: "query and json", target: "/v1/transit/encrypt/key?key_version=2&context=a", contentType: "application/json", body: `{"plaintext":"dGVzdA==","context":"b"}`, data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": "2", "context": "b"}},
+		{name: "query and form", target: "/v1/transit/encrypt/key?key_version=2", contentType: "application/x-www-form-urlencoded", body: "plaintext=dGVzdA%3D%3D", data: map[string]interface{}{"plaintext": "dGVzdA==", "key_version": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(tt.target, tt.contentType, tt.body)
+			data, err := getRequestParameters(c)
+			require.NoError(t, err)
+			require.Equal(t, tt.data, data)
+			requireRestoredBody(t, c, tt.body)
+		})
+	}
+}
+
+func TestGetRequestParameters_Multipart(t *testing.T) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	require.NoError(t, w.WriteField("policy", "path \"*\" {}"))
+	require.NoError(t, w.Close())
+
+	c := newTestContext("/v1/sys/policy/test", w.FormDataContentType(), body.String())
+	data, err := getRequestParameters(c)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"policy": "path \"*\" {}"}, data)
+	requireRestoredBody(t, c, body.String())
+}
+
+func TestGetRequestParameters_Invalid(t *testing.T) {
+	for _, body := range []string{`["plaintext"]`, `plaintext=dGVzdA==`, `{"plaintext":`} {
+		c := newTestContext("/v1/transit/encrypt/key", "application/json", body)
+		_, err := getRequestParameters(c)
+		require.Error(t, err, body)
+	}
+}